@@ -1,11 +1,13 @@
 package chapter3
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -43,14 +45,15 @@ func TestPool(t *testing.T) {
 }
 
 func TestPoolV2(t *testing.T) {
-	// Variable to count how many new objects were created by the pool
-	var numCalcsCreated int
+	// Variable to count how many new objects were created by the pool. New runs on many
+	// goroutines at once, so the counter is atomic
+	var numCalcsCreated atomic.Int64
 
 	// Define a sync.Pool that manages []byte slices of size 1024
 	calcPool := &sync.Pool{
 		New: func() interface{} {
 			// This function is called whenever the pool needs to create a new object
-			numCalcsCreated += 1      // Increment the counter for each new object created
+			numCalcsCreated.Add(1)    // Increment the counter for each new object created
 			mem := make([]byte, 1024) // Allocate memory for the new object
 			return &mem               // Return a pointer to the memory
 		},
@@ -84,7 +87,7 @@ func TestPoolV2(t *testing.T) {
 	wg.Wait()
 
 	// Print the total number of objects created by the pool
-	fmt.Printf("%d calculators were created.", numCalcsCreated)
+	fmt.Printf("%d calculators were created.", numCalcsCreated.Load())
 }
 
 func connectToService() interface{} {
@@ -92,59 +95,62 @@ func connectToService() interface{} {
 	return struct{}{}
 }
 
-func warmServiceConnCache() *sync.Pool {
-	p := &sync.Pool{
-		New: connectToService,
-	}
-	for i := 0; i < 10; i++ {
-		p.Put(p.New)
+// warmServiceConnCache used a sync.Pool and called p.Put(p.New), which cached the
+// function rather than a connection. A ResourcePool really dials its 10 connections up
+// front, concurrently, and keeps them.
+func warmServiceConnCache() *ResourcePool[interface{}] {
+	p, err := NewResourcePool(PoolOptions[interface{}]{
+		New: func(ctx context.Context) (interface{}, error) {
+			return connectToService(), nil
+		},
+		Min: 10,
+		Max: 10,
+	})
+	if err != nil {
+		log.Fatalf("cannot warm connection cache: %v", err)
 	}
 	return p
 }
 
-func startNetworkDaemon() *sync.WaitGroup {
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		connPool := warmServiceConnCache()
-
-		server, err := net.Listen("tcp", "localhost:8080")
-		if err != nil {
-			log.Fatalf("cannot listen: %v", err)
-		}
-		defer server.Close()
-
-		wg.Done()
+func startNetworkDaemon() (*Daemon, error) {
+	connPool := warmServiceConnCache()
 
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				log.Printf("cannot accept connection: %v", err)
-				continue
-			}
+	daemon := &Daemon{
+		Address: "localhost:0",
+		Handler: func(done <-chan struct{}, conn net.Conn) {
 			// connectToService()
 			// fmt.Fprintln(conn, "")
-			// conn.Close()
 
-			svcConn := connPool.Get()
+			svcConn, err := connPool.Get(context.Background())
+			if err != nil {
+				log.Printf("cannot get service connection: %v", err)
+				return
+			}
 			fmt.Fprintln(conn, "")
-			connPool.Put(svcConn)
-			conn.Close()
-		}
-	}()
-
-	return &wg
+			svcConn.Release()
+		},
+	}
+	if err := daemon.Start(); err != nil {
+		connPool.Close()
+		return nil, err
+	}
+	return daemon, nil
 }
 
-func init() {
-	daemonStarted := startNetworkDaemon()
-	daemonStarted.Wait()
-}
+// networkDaemon is started by the first benchmark that needs it, not by importing the
+// package, and shared by the benchmark runs after that.
+var networkDaemon = NewOnceValue(startNetworkDaemon, OnceOptions{})
 
 func BenchmarkNetworkRequest(b *testing.B) {
+	daemon, err := networkDaemon.Get()
+	if err != nil {
+		b.Fatalf("cannot start daemon: %v", err)
+	}
+	addr := daemon.Addr().String()
+	b.ResetTimer()
+
 	for i := 0; i < b.N; i++ {
-		conn, err := net.Dial("tcp", "localhost:8080")
+		conn, err := net.Dial("tcp", addr)
 		if err != nil {
 			b.Fatalf("cannot dial host: %v", err)
 		}
@@ -0,0 +1,195 @@
+package chapter3
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Broadcaster
+//
+// sync.Cond.Broadcast, as used in TestBroadcast and for the cadence in TestLivelock, wakes
+// every waiter but tells them nothing, and a goroutine can only wait on it with c.Wait, not
+// in a select. Broadcaster sends a value to every listener instead, each on a channel of
+// its own. A listener that does not keep up is handled by a SlowListenerPolicy, and with
+// Replay a listener that joins late starts with the latest value.
+
+// SlowListenerPolicy decides what Send does when a listener's channel is full.
+type SlowListenerPolicy int
+
+const (
+	// WaitForListener blocks Send until the listener made room.
+	WaitForListener SlowListenerPolicy = iota
+	// SkipListener drops the value for that listener.
+	SkipListener
+	// DisconnectListener closes the listener's channel and removes it.
+	DisconnectListener
+)
+
+func (p SlowListenerPolicy) String() string {
+	switch p {
+	case WaitForListener:
+		return "wait"
+	case SkipListener:
+		return "skip"
+	case DisconnectListener:
+		return "disconnect"
+	}
+	return fmt.Sprintf("SlowListenerPolicy(%d)", int(p))
+}
+
+// BroadcasterOptions configures a Broadcaster.
+type BroadcasterOptions struct {
+	// Buffer is the capacity of every listener's channel.
+	Buffer int
+
+	Slow SlowListenerPolicy
+
+	// Replay sends the latest value to a listener as soon as it joins.
+	Replay bool
+}
+
+// Broadcaster sends values to all of its listeners. It is safe for concurrent use.
+type Broadcaster[T any] struct {
+	opts BroadcasterOptions
+
+	// quit is closed by Close before it takes mu, so a Send blocked on a listener lets go
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// mu is held for a whole Send, so every listener sees the values in the same order
+	mu        sync.Mutex
+	listeners map[*Listener[T]]struct{}
+	latest    T
+	hasLatest bool
+	closed    bool
+}
+
+// Listener receives the values of a Broadcaster on C.
+type Listener[T any] struct {
+	// C is closed when the listener is closed, disconnected, or the broadcaster is closed.
+	C <-chan T
+
+	c            chan T
+	b            *Broadcaster[T]
+	quit         chan struct{}
+	quitOnce     sync.Once
+	dropped      atomic.Int64
+	disconnected atomic.Bool
+}
+
+// NewBroadcaster returns a Broadcaster without listeners.
+func NewBroadcaster[T any](opts BroadcasterOptions) *Broadcaster[T] {
+	return &Broadcaster[T]{
+		opts:      opts,
+		quit:      make(chan struct{}),
+		listeners: make(map[*Listener[T]]struct{}),
+	}
+}
+
+// Listen adds a listener, which receives every value sent from now on.
+func (b *Broadcaster[T]) Listen() *Listener[T] {
+	size := b.opts.Buffer
+	if b.opts.Replay {
+		// room for the replayed value
+		size = max(size, 1)
+	}
+	c := make(chan T, size)
+	l := &Listener[T]{C: c, c: c, b: b, quit: make(chan struct{})}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(c)
+		return l
+	}
+	if b.opts.Replay && b.hasLatest {
+		c <- b.latest
+	}
+	b.listeners[l] = struct{}{}
+	return l
+}
+
+// Send sends v to every listener and returns the number of listeners that got it. With
+// WaitForListener a listener that stopped reading blocks Send, and Listen behind it,
+// until the listener or the broadcaster is closed.
+func (b *Broadcaster[T]) Send(v T) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0
+	}
+	b.latest, b.hasLatest = v, true
+
+	sent := 0
+	for l := range b.listeners {
+		select {
+		case l.c <- v:
+			sent++
+			continue
+		default:
+		}
+
+		switch b.opts.Slow {
+		case SkipListener:
+			l.dropped.Add(1)
+		case DisconnectListener:
+			l.disconnected.Store(true)
+			b.remove(l)
+		default:
+			select {
+			case l.c <- v:
+				sent++
+			case <-l.quit:
+				// Close is waiting for the lock to remove l
+			case <-b.quit:
+				// Close is waiting for the lock, the remaining listeners are closed anyway
+				return sent
+			}
+		}
+	}
+	return sent
+}
+
+// Close closes the channel of every listener. Later listeners get a closed channel and
+// later values are dropped.
+func (b *Broadcaster[T]) Close() {
+	b.quitOnce.Do(func() { close(b.quit) })
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for l := range b.listeners {
+		b.remove(l)
+	}
+}
+
+// remove is called with b.mu held.
+func (b *Broadcaster[T]) remove(l *Listener[T]) {
+	if _, ok := b.listeners[l]; ok {
+		delete(b.listeners, l)
+		close(l.c)
+	}
+}
+
+// Close removes the listener and closes C. A Send blocked on this listener moves on.
+func (l *Listener[T]) Close() {
+	l.quitOnce.Do(func() { close(l.quit) })
+
+	l.b.mu.Lock()
+	defer l.b.mu.Unlock()
+	l.b.remove(l)
+}
+
+// Dropped returns the number of values skipped because the listener was slow.
+func (l *Listener[T]) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Disconnected reports whether the broadcaster disconnected the listener for being slow.
+func (l *Listener[T]) Disconnected() bool {
+	return l.disconnected.Load()
+}
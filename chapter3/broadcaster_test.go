@@ -0,0 +1,113 @@
+package chapter3
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcaster(t *testing.T) {
+	b := NewBroadcaster[string](BroadcasterOptions{})
+
+	var listening, received sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		l := b.Listen()
+		listening.Add(1)
+		received.Add(1)
+		go func() {
+			defer received.Done()
+			listening.Done()
+			// unlike c.Wait, a listener can also wait for other things
+			select {
+			case v := <-l.C:
+				if v != "click" {
+					t.Errorf("received %q", v)
+				}
+			case <-time.After(time.Second):
+				t.Error("no value")
+			}
+		}()
+	}
+
+	listening.Wait()
+	if n := b.Send("click"); n != 3 {
+		t.Fatalf("sent to %d listeners, want 3", n)
+	}
+	received.Wait()
+}
+
+func TestBroadcasterSlowListener(t *testing.T) {
+	skip := NewBroadcaster[int](BroadcasterOptions{Buffer: 1, Slow: SkipListener})
+	l := skip.Listen()
+	for i := 1; i <= 3; i++ {
+		skip.Send(i)
+	}
+	if v := <-l.C; v != 1 || l.Dropped() != 2 {
+		t.Fatalf("received %d with %d dropped, want 1 and 2", v, l.Dropped())
+	}
+
+	disconnect := NewBroadcaster[int](BroadcasterOptions{Slow: DisconnectListener})
+	l = disconnect.Listen()
+	if n := disconnect.Send(1); n != 0 {
+		t.Fatalf("sent to %d listeners nobody reads", n)
+	}
+	if _, ok := <-l.C; ok || !l.Disconnected() {
+		t.Fatal("slow listener was not disconnected")
+	}
+
+	// a Send waiting for a listener moves on when that listener closes
+	wait := NewBroadcaster[int](BroadcasterOptions{})
+	l = wait.Listen()
+	sent := make(chan int)
+	go func() { sent <- wait.Send(1) }()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	if n := <-sent; n != 0 {
+		t.Fatalf("sent to %d listeners, want 0", n)
+	}
+}
+
+func TestBroadcasterReplay(t *testing.T) {
+	b := NewBroadcaster[int](BroadcasterOptions{Replay: true})
+	b.Send(1)
+	b.Send(2)
+
+	late := b.Listen()
+	if v := <-late.C; v != 2 {
+		t.Fatalf("late listener got %d, want the latest value 2", v)
+	}
+
+	b.Close()
+	if _, ok := <-late.C; ok {
+		t.Fatal("Close did not close the listener")
+	}
+	if _, ok := <-b.Listen().C; ok {
+		t.Fatal("listener of a closed broadcaster is open")
+	}
+}
+
+func TestBroadcasterCloseDuringSend(t *testing.T) {
+	// nobody reads l, so Send blocks on it while holding the lock Close needs
+	b := NewBroadcaster[int](BroadcasterOptions{})
+	l := b.Listen()
+	sent := make(chan int)
+	go func() { sent <- b.Send(1) }()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked behind a Send waiting for a listener")
+	}
+	if n := <-sent; n != 0 {
+		t.Fatalf("sent to %d listeners, want 0", n)
+	}
+	if _, ok := <-l.C; ok {
+		t.Fatal("listener not closed")
+	}
+}
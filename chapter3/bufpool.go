@@ -0,0 +1,119 @@
+package chapter3
+
+import (
+	"encoding/json"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffer pool
+//
+// TestPoolV2 pools 1024-byte slices only. BufferPool serves any size by keeping a
+// sync.Pool per power of two between a minimum and a maximum size: Get(n) takes a buffer
+// from the smallest class that fits n, and Put returns it to the class of its capacity.
+// Buffers larger than the biggest class are allocated and dropped as needed, so one huge
+// request does not keep a huge buffer alive in the pool.
+//
+// The pool counts what it does with atomic counters, and String returns them as JSON, so
+// a pool can be published as is with expvar.Publish.
+
+// BufferPoolStats are the counters of a BufferPool.
+type BufferPoolStats struct {
+	// Gets is the number of Get calls, Hits of those served from the pool and Misses of
+	// those that found their class empty.
+	Gets   int64 `json:"gets"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+
+	// News is the number of buffers allocated, including the oversize ones.
+	News int64 `json:"news"`
+
+	// Puts is the number of Put calls, Drops of those rejected because the buffer did
+	// not fit any class.
+	Puts  int64 `json:"puts"`
+	Drops int64 `json:"drops"`
+}
+
+// BufferPool is a pool of byte buffers in power-of-two size classes. It is safe for
+// concurrent use.
+type BufferPool struct {
+	minShift int
+	classes  []sync.Pool
+
+	gets, hits, misses, news, puts, drops atomic.Int64
+}
+
+// NewBufferPool returns a pool with classes from minSize to maxSize, both rounded up to a
+// power of two.
+func NewBufferPool(minSize, maxSize int) *BufferPool {
+	minShift := shiftFor(max(minSize, 1))
+	maxShift := max(shiftFor(max(maxSize, 1)), minShift)
+	return &BufferPool{
+		minShift: minShift,
+		classes:  make([]sync.Pool, maxShift-minShift+1),
+	}
+}
+
+// shiftFor returns the exponent of the smallest power of two >= n.
+func shiftFor(n int) int {
+	return bits.Len(uint(n - 1))
+}
+
+// Get returns a buffer of length n. Its capacity is the size of its class, or n for
+// buffers larger than the biggest class.
+func (p *BufferPool) Get(n int) *[]byte {
+	p.gets.Add(1)
+
+	class := max(shiftFor(max(n, 1)), p.minShift) - p.minShift
+	if class >= len(p.classes) {
+		p.misses.Add(1)
+		p.news.Add(1)
+		b := make([]byte, n)
+		return &b
+	}
+
+	if b, ok := p.classes[class].Get().(*[]byte); ok {
+		p.hits.Add(1)
+		*b = (*b)[:n]
+		return b
+	}
+	p.misses.Add(1)
+	p.news.Add(1)
+	b := make([]byte, n, 1<<(class+p.minShift))
+	return &b
+}
+
+// Put returns a buffer to the pool. Buffers whose capacity is not the size of a class,
+// such as oversize ones, are dropped.
+func (p *BufferPool) Put(b *[]byte) {
+	p.puts.Add(1)
+
+	c := cap(*b)
+	class := shiftFor(max(c, 1)) - p.minShift
+	if c == 0 || c&(c-1) != 0 || class < 0 || class >= len(p.classes) {
+		p.drops.Add(1)
+		return
+	}
+	*b = (*b)[:0]
+	p.classes[class].Put(b)
+}
+
+// Stats returns the counters. They are read one by one, so a snapshot taken under load
+// can be off by the calls in flight.
+func (p *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:   p.gets.Load(),
+		Hits:   p.hits.Load(),
+		Misses: p.misses.Load(),
+		News:   p.news.Load(),
+		Puts:   p.puts.Load(),
+		Drops:  p.drops.Load(),
+	}
+}
+
+// String returns the counters as JSON, which makes the pool an expvar.Var.
+func (p *BufferPool) String() string {
+	b, _ := json.Marshal(p.Stats())
+	return string(b)
+}
@@ -0,0 +1,74 @@
+package chapter3
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolClasses(t *testing.T) {
+	p := NewBufferPool(100, 4096)
+	for _, tt := range []struct{ n, cap int }{
+		{0, 128}, {1, 128}, {128, 128}, {129, 256}, {4096, 4096}, {5000, 5000},
+	} {
+		b := p.Get(tt.n)
+		if len(*b) != tt.n || cap(*b) != tt.cap {
+			t.Errorf("Get(%d): len %d cap %d, want cap %d", tt.n, len(*b), cap(*b), tt.cap)
+		}
+		p.Put(b)
+	}
+
+	odd := make([]byte, 300)
+	p.Put(&odd)
+
+	s := p.Stats()
+	if s.Gets != 6 || s.Puts != 7 || s.Drops != 2 || s.Hits+s.Misses != s.Gets {
+		t.Fatalf("stats %+v, want 6 gets, 7 puts, 2 drops", s)
+	}
+}
+
+func TestBufferPoolConcurrent(t *testing.T) {
+	// TestPoolV2 with many sizes, and counters that survive -race
+	p := NewBufferPool(512, 8192)
+	var workers sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			for j := 0; j < 1000; j++ {
+				b := p.Get((i*j)%10000 + 1)
+				(*b)[0] = byte(j)
+				p.Put(b)
+			}
+		}(i)
+	}
+	workers.Wait()
+
+	s := p.Stats()
+	fmt.Printf("%+v\n", s)
+	if s.Gets != 64000 || s.Puts != 64000 || s.Hits+s.Misses != s.Gets || s.News != s.Misses {
+		t.Fatalf("inconsistent stats %+v", s)
+	}
+	if s.Hits == 0 {
+		t.Fatal("no buffer was reused")
+	}
+}
+
+func TestBufferPoolExpvar(t *testing.T) {
+	p := NewBufferPool(1024, 1024)
+	p.Put(p.Get(10))
+
+	name := fmt.Sprintf("chapter3.%s.%d", t.Name(), time.Now().UnixNano())
+	expvar.Publish(name, p)
+
+	var s BufferPoolStats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Gets != 1 || s.Puts != 1 {
+		t.Fatalf("published stats %+v", s)
+	}
+}
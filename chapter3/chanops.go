@@ -0,0 +1,155 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Channel operations with a way out
+//
+// TestSelectV3 writes a receive that gives up as a select with time.After and default.
+// time.After allocates a timer on every call, which the garbage collector only gets back
+// once it fired, so on a hot path the helpers below take their timers from a pool instead
+// and try the operation once before touching a timer at all.
+//
+// Every helper tells apart why it gave up: ErrWouldBlock, ErrTimeout, ErrClosed or
+// ErrCanceled. Sending on a closed channel panics, like the send statement does.
+
+var (
+	// ErrWouldBlock is returned by TryRecv and TrySend when the channel is not ready.
+	ErrWouldBlock = errors.New("chapter3: channel operation would block")
+
+	// ErrTimeout is returned when the channel was not ready before the timeout.
+	ErrTimeout = errors.New("chapter3: channel operation timed out")
+
+	// ErrClosed is returned by receives from a closed channel.
+	ErrClosed = errors.New("chapter3: channel closed")
+
+	// ErrCanceled is returned when the context was done first. The error also matches
+	// the context's own error with errors.Is.
+	ErrCanceled = errors.New("chapter3: channel operation canceled")
+)
+
+// TryRecv receives from c if a value is ready.
+func TryRecv[T any](c <-chan T) (T, error) {
+	select {
+	case v, ok := <-c:
+		if !ok {
+			return v, ErrClosed
+		}
+		return v, nil
+	default:
+		var zero T
+		return zero, ErrWouldBlock
+	}
+}
+
+// TrySend sends v on c if a receiver or buffer space is ready.
+func TrySend[T any](c chan<- T, v T) error {
+	select {
+	case c <- v:
+		return nil
+	default:
+		return ErrWouldBlock
+	}
+}
+
+// RecvTimeout receives from c, waiting at most d.
+func RecvTimeout[T any](c <-chan T, d time.Duration) (T, error) {
+	if v, err := TryRecv(c); err != ErrWouldBlock || d <= 0 {
+		if err == ErrWouldBlock {
+			err = ErrTimeout
+		}
+		return v, err
+	}
+
+	t := getTimer(d)
+	defer putTimer(t)
+
+	select {
+	case v, ok := <-c:
+		if !ok {
+			return v, ErrClosed
+		}
+		return v, nil
+	case <-t.C:
+		var zero T
+		return zero, ErrTimeout
+	}
+}
+
+// SendTimeout sends v on c, waiting at most d.
+func SendTimeout[T any](c chan<- T, v T, d time.Duration) error {
+	if err := TrySend(c, v); err == nil || d <= 0 {
+		if err != nil {
+			err = ErrTimeout
+		}
+		return err
+	}
+
+	t := getTimer(d)
+	defer putTimer(t)
+
+	select {
+	case c <- v:
+		return nil
+	case <-t.C:
+		return ErrTimeout
+	}
+}
+
+// RecvCtx receives from c until ctx is done. A deadline of ctx that passes is reported as
+// ErrTimeout, any other reason as ErrCanceled.
+func RecvCtx[T any](ctx context.Context, c <-chan T) (T, error) {
+	select {
+	case v, ok := <-c:
+		if !ok {
+			return v, ErrClosed
+		}
+		return v, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctxErr(ctx)
+	}
+}
+
+// SendCtx sends v on c until ctx is done, with the errors of RecvCtx.
+func SendCtx[T any](ctx context.Context, c chan<- T, v T) error {
+	select {
+	case c <- v:
+		return nil
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	}
+}
+
+func ctxErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
+	return fmt.Errorf("%w: %w", ErrCanceled, ctx.Err())
+}
+
+var timers sync.Pool
+
+func getTimer(d time.Duration) *time.Timer {
+	if t, ok := timers.Get().(*time.Timer); ok {
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// putTimer stops t and empties its channel, so the next Reset starts clean.
+func putTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	timers.Put(t)
+}
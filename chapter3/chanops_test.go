@@ -0,0 +1,118 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTryRecvSend(t *testing.T) {
+	c := make(chan int, 1)
+	if _, err := TryRecv(c); err != ErrWouldBlock {
+		t.Fatalf("TryRecv on an empty channel: %v", err)
+	}
+	if err := TrySend(c, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := TrySend(c, 2); err != ErrWouldBlock {
+		t.Fatalf("TrySend on a full channel: %v", err)
+	}
+	if v, err := TryRecv(c); v != 1 || err != nil {
+		t.Fatalf("TryRecv = %d, %v", v, err)
+	}
+	close(c)
+	if _, err := TryRecv(c); err != ErrClosed {
+		t.Fatalf("TryRecv on a closed channel: %v", err)
+	}
+}
+
+func TestRecvSendTimeout(t *testing.T) {
+	// the select from TestSelectV3, without the inline time.After
+	var never chan int
+	start := time.Now()
+	if _, err := RecvTimeout(never, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("RecvTimeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Fatalf("RecvTimeout gave up after %v", elapsed)
+	}
+	if err := SendTimeout(never, 1, time.Millisecond); err != ErrTimeout {
+		t.Fatalf("SendTimeout: %v", err)
+	}
+
+	// a pooled timer that fired before must not time out the next call early
+	c := make(chan int)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		c <- 1
+	}()
+	if v, err := RecvTimeout(c, time.Second); v != 1 || err != nil {
+		t.Fatalf("RecvTimeout = %d, %v", v, err)
+	}
+	close(c)
+	if _, err := RecvTimeout(c, time.Second); err != ErrClosed {
+		t.Fatalf("RecvTimeout on a closed channel: %v", err)
+	}
+}
+
+func TestRecvCtx(t *testing.T) {
+	c := make(chan int)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RecvCtx(ctx, c); !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("RecvCtx after cancel: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := SendCtx(ctx, c, 1); !errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		t.Fatalf("SendCtx after the deadline: %v", err)
+	}
+
+	close(c)
+	if _, err := RecvCtx(context.Background(), c); err != ErrClosed {
+		t.Fatalf("RecvCtx on a closed channel: %v", err)
+	}
+}
+
+func BenchmarkTimeAfter(b *testing.B) {
+	c := make(chan int, 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c <- i
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func BenchmarkRecvTimeout(b *testing.B) {
+	c := make(chan int, 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c <- i
+		RecvTimeout(c, time.Second)
+	}
+}
+
+func BenchmarkRecvTimeoutWaiting(b *testing.B) {
+	c := make(chan int)
+	done := make(chan struct{})
+	b.Cleanup(func() { close(done) })
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case c <- i:
+			}
+		}
+	}()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		RecvTimeout(c, time.Second)
+	}
+}
@@ -0,0 +1,205 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Network daemon
+//
+// startNetworkDaemon used to be started from init, so every test binary of this package
+// listened on localhost:8080, died with log.Fatalf when the port was taken, and spun on
+// Accept errors without pause. Daemon is the same accept loop with a lifecycle: Start
+// listens on a configurable address, Shutdown stops accepting, waits for the open
+// connections and returns.
+
+// ErrDaemonStarted is returned by Start and Serve on a daemon that was already started.
+var ErrDaemonStarted = errors.New("chapter3: daemon already started")
+
+// Daemon serves TCP connections, one goroutine per connection.
+type Daemon struct {
+	// Address is the address to listen on, "localhost:0" picks a free port.
+	Address string
+
+	// Handler serves a connection, which the daemon closes when Handler returns. done is
+	// closed when Shutdown gave up waiting for the handlers.
+	Handler func(done <-chan struct{}, conn net.Conn)
+
+	// MaxAcceptBackoff caps the wait after a failed Accept, which starts at 5ms and
+	// doubles with every failure in a row. Zero means one second.
+	MaxAcceptBackoff time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	started  bool
+	closing  bool
+	handlers sync.WaitGroup
+	quit     chan struct{}
+	serving  chan struct{}
+	force    chan struct{}
+}
+
+// Start listens on Address and serves connections in the background.
+func (d *Daemon) Start() error {
+	addr := d.Address
+	if addr == "" {
+		addr = "localhost:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := d.init(ln); err != nil {
+		ln.Close()
+		return err
+	}
+	go d.serve(ln)
+	return nil
+}
+
+// Serve serves the connections accepted by ln until Shutdown.
+func (d *Daemon) Serve(ln net.Listener) error {
+	if err := d.init(ln); err != nil {
+		return err
+	}
+	d.serve(ln)
+	return nil
+}
+
+func (d *Daemon) init(ln net.Listener) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.started {
+		return ErrDaemonStarted
+	}
+	d.started = true
+	d.listener = ln
+	d.conns = make(map[net.Conn]struct{})
+	d.quit = make(chan struct{})
+	d.serving = make(chan struct{})
+	d.force = make(chan struct{})
+	return nil
+}
+
+// Addr returns the address the daemon listens on, nil before Start.
+func (d *Daemon) Addr() net.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listener == nil {
+		return nil
+	}
+	return d.listener.Addr()
+}
+
+func (d *Daemon) serve(ln net.Listener) {
+	defer close(d.serving)
+
+	maxBackoff := d.MaxAcceptBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Second
+	}
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if d.isClosing() {
+				return
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff = min(2*backoff, maxBackoff)
+			}
+			log.Printf("cannot accept connection: %v; retrying in %v", err, backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-d.quit:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if !d.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer d.untrack(conn)
+			d.Handler(d.force, conn)
+		}()
+	}
+}
+
+func (d *Daemon) isClosing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closing
+}
+
+// track registers a new connection, unless the daemon is shutting down.
+func (d *Daemon) track(conn net.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closing {
+		return false
+	}
+	d.conns[conn] = struct{}{}
+	d.handlers.Add(1)
+	return true
+}
+
+func (d *Daemon) untrack(conn net.Conn) {
+	conn.Close()
+
+	d.mu.Lock()
+	delete(d.conns, conn)
+	d.mu.Unlock()
+	d.handlers.Done()
+}
+
+// Shutdown stops accepting connections and waits for the open ones to be served. When
+// ctx is done first, it closes done for the handlers and every open connection, waits for
+// the handlers to return and reports the context's error.
+func (d *Daemon) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.started || d.closing {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closing = true
+	close(d.quit)
+	err := d.listener.Close()
+	d.mu.Unlock()
+	<-d.serving
+
+	drained := make(chan struct{})
+	go func() {
+		d.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		close(d.force)
+		d.mu.Lock()
+		for conn := range d.conns {
+			conn.Close()
+		}
+		d.mu.Unlock()
+		<-drained
+		err = ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDaemonShutdownDrains(t *testing.T) {
+	release := make(chan struct{})
+	d := &Daemon{Handler: func(done <-chan struct{}, conn net.Conn) {
+		<-release
+		io.WriteString(conn, "bye\n")
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != ErrDaemonStarted {
+		t.Fatalf("second Start: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", d.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- d.Shutdown(context.Background()) }()
+
+	// no new connections while the open one is served
+	time.Sleep(10 * time.Millisecond)
+	if c, err := net.Dial("tcp", d.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("daemon accepted a connection during Shutdown")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a connection open", err)
+	default:
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(conn); string(b) != "bye\n" {
+		t.Fatalf("read %q", b)
+	}
+}
+
+func TestDaemonShutdownDeadline(t *testing.T) {
+	var forced atomic.Bool
+	d := &Daemon{Handler: func(done <-chan struct{}, conn net.Conn) {
+		<-done
+		forced.Store(true)
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", d.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) || !forced.Load() {
+		t.Fatalf("Shutdown = %v, handler stopped: %v", err, forced.Load())
+	}
+}
+
+// failingListener fails every Accept until it is closed.
+type failingListener struct {
+	net.Listener
+	accepts atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	return nil, errors.New("too many open files")
+}
+
+func TestDaemonAcceptBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := &failingListener{Listener: ln}
+	d := &Daemon{MaxAcceptBackoff: 20 * time.Millisecond}
+	go d.Serve(failing)
+
+	// 5+10+20+20+20 ms: a handful of attempts, not a busy loop
+	time.Sleep(80 * time.Millisecond)
+	if n := failing.accepts.Load(); n < 3 || n > 8 {
+		t.Fatalf("%d accepts in 80ms", n)
+	}
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package chapter3
+
+import "reflect"
+
+// Dynamic select
+//
+// The cases of a select statement are fixed when the program is compiled, which is why
+// the or-channel in TestOrChannels recurses to wait on any number of channels. reflect.Select
+// takes its cases as a slice instead, but works on reflect.Values. DynamicSelect keeps
+// that slice for a set of channels of one element type, so cases can be added and removed
+// between selects and the value comes back typed.
+//
+// The price is speed: reflect.Select allocates for every receive case on every call, so a
+// select over 4 channels is about 4 times slower than the statement, and the cost grows
+// with the number of cases (see the benchmarks). Use it when the set of channels really
+// is only known at runtime.
+
+// CaseID identifies a case of a DynamicSelect. IDs are never reused.
+type CaseID int
+
+// Selected is the case a DynamicSelect picked. For a receive, Value and OK are what a
+// "v, ok := <-c" would have returned; for a send, OK is true and Value is the value sent.
+type Selected[T any] struct {
+	ID    CaseID
+	Value T
+	OK    bool
+}
+
+// DynamicSelect selects over a set of channels that can change at runtime. It is not safe
+// for concurrent use.
+type DynamicSelect[T any] struct {
+	// cases[0] is the done channel of the current Select
+	cases []reflect.SelectCase
+	ids   []CaseID
+	index map[CaseID]int
+	next  CaseID
+}
+
+// NewDynamicSelect returns an empty DynamicSelect.
+func NewDynamicSelect[T any]() *DynamicSelect[T] {
+	return &DynamicSelect[T]{
+		cases: []reflect.SelectCase{{Dir: reflect.SelectRecv}},
+		ids:   []CaseID{-1},
+		index: make(map[CaseID]int),
+	}
+}
+
+// AddRecv adds a case receiving from c.
+func (s *DynamicSelect[T]) AddRecv(c <-chan T) CaseID {
+	return s.add(reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+}
+
+// AddSend adds a case sending v on c. The case stays until it is removed, so it sends v
+// again every time it is picked.
+func (s *DynamicSelect[T]) AddSend(c chan<- T, v T) CaseID {
+	return s.add(reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(c), Send: reflect.ValueOf(&v).Elem()})
+}
+
+func (s *DynamicSelect[T]) add(c reflect.SelectCase) CaseID {
+	id := s.next
+	s.next++
+	s.index[id] = len(s.cases)
+	s.cases = append(s.cases, c)
+	s.ids = append(s.ids, id)
+	return id
+}
+
+// Remove removes a case, and reports whether it was there.
+func (s *DynamicSelect[T]) Remove(id CaseID) bool {
+	i, ok := s.index[id]
+	if !ok {
+		return false
+	}
+
+	// move the last case into the hole
+	last := len(s.cases) - 1
+	s.cases[i], s.ids[i] = s.cases[last], s.ids[last]
+	s.index[s.ids[i]] = i
+	s.cases[last] = reflect.SelectCase{}
+	s.cases, s.ids = s.cases[:last], s.ids[:last]
+	delete(s.index, id)
+	return true
+}
+
+// Len returns the number of cases.
+func (s *DynamicSelect[T]) Len() int {
+	return len(s.cases) - 1
+}
+
+// Select blocks until one of the cases can proceed, or done is closed. With no cases it
+// waits for done alone. ok is false when done was closed.
+func (s *DynamicSelect[T]) Select(done <-chan interface{}) (Selected[T], bool) {
+	s.cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)}
+	defer func() { s.cases[0].Chan = reflect.Value{} }()
+
+	chosen, v, ok := reflect.Select(s.cases)
+	if chosen == 0 {
+		return Selected[T]{ID: -1}, false
+	}
+	return s.selected(chosen, v, ok), true
+}
+
+// TrySelect is Select with a default case: ok is false when no case could proceed right
+// away.
+func (s *DynamicSelect[T]) TrySelect() (Selected[T], bool) {
+	s.cases[0] = reflect.SelectCase{Dir: reflect.SelectDefault}
+	defer func() { s.cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv} }()
+
+	chosen, v, ok := reflect.Select(s.cases)
+	if chosen == 0 {
+		return Selected[T]{ID: -1}, false
+	}
+	return s.selected(chosen, v, ok), true
+}
+
+func (s *DynamicSelect[T]) selected(chosen int, v reflect.Value, ok bool) Selected[T] {
+	if c := s.cases[chosen]; c.Dir == reflect.SelectSend {
+		v, ok = c.Send, true
+	}
+
+	// the comma-ok form keeps nil values of interface types from panicking
+	r := Selected[T]{ID: s.ids[chosen], OK: ok}
+	if ok {
+		r.Value, _ = v.Interface().(T)
+	}
+	return r
+}
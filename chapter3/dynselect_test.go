@@ -0,0 +1,107 @@
+package chapter3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDynamicSelect(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	s := NewDynamicSelect[int]()
+	a, b := make(chan int, 1), make(chan int, 1)
+	idA, idB := s.AddRecv(a), s.AddRecv(b)
+
+	b <- 2
+	if r, ok := s.Select(done); !ok || r.ID != idB || r.Value != 2 || !r.OK {
+		t.Fatalf("Select = %+v, %v; want value 2 from b", r, ok)
+	}
+
+	// a closed channel reports ok false, like a receive statement
+	close(a)
+	if r, _ := s.Select(done); r.ID != idA || r.OK {
+		t.Fatalf("Select = %+v, want a closed", r)
+	}
+	if !s.Remove(idA) || s.Remove(idA) || s.Len() != 1 {
+		t.Fatal("Remove did not remove a exactly once")
+	}
+
+	if _, ok := s.TrySelect(); ok {
+		t.Fatal("TrySelect picked a case with nothing ready")
+	}
+
+	out := make(chan int, 1)
+	idOut := s.AddSend(out, 7)
+	if r, ok := s.TrySelect(); !ok || r.ID != idOut || r.Value != 7 || <-out != 7 {
+		t.Fatalf("TrySelect = %+v, %v; want the send of 7", r, ok)
+	}
+}
+
+func TestDynamicSelectDone(t *testing.T) {
+	done := make(chan interface{})
+	s := NewDynamicSelect[interface{}]()
+	s.AddRecv(make(chan interface{}))
+
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+	if r, ok := s.Select(done); ok || r.ID != -1 {
+		t.Fatalf("Select = %+v, %v; want done", r, ok)
+	}
+}
+
+// TestDynamicSelectOr waits on any number of channels without the recursion of
+// TestOrChannels.
+func TestDynamicSelectOr(t *testing.T) {
+	after := func(d time.Duration) <-chan interface{} {
+		c := make(chan interface{})
+		time.AfterFunc(d, func() { close(c) })
+		return c
+	}
+
+	s := NewDynamicSelect[interface{}]()
+	for _, d := range []time.Duration{time.Hour, time.Minute, 10 * time.Millisecond, time.Second} {
+		s.AddRecv(after(d))
+	}
+
+	start := time.Now()
+	if r, _ := s.Select(nil); r.ID != 2 {
+		t.Fatalf("case %d fired first, want 2", r.ID)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("done after %v", elapsed)
+	}
+}
+
+func BenchmarkSelectStatement(b *testing.B) {
+	c := [4]chan int{make(chan int, 1), make(chan int, 1), make(chan int, 1), make(chan int, 1)}
+	for i := 0; i < b.N; i++ {
+		c[i%4] <- i
+		select {
+		case <-c[0]:
+		case <-c[1]:
+		case <-c[2]:
+		case <-c[3]:
+		}
+	}
+}
+
+func benchmarkDynamicSelect(b *testing.B, n int) {
+	done := make(chan interface{})
+	s := NewDynamicSelect[int]()
+	c := make([]chan int, n)
+	for i := range c {
+		c[i] = make(chan int, 1)
+		s.AddRecv(c[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c[i%n] <- i
+		s.Select(done)
+	}
+}
+
+func BenchmarkDynamicSelect4(b *testing.B)   { benchmarkDynamicSelect(b, 4) }
+func BenchmarkDynamicSelect64(b *testing.B)  { benchmarkDynamicSelect(b, 64) }
+func BenchmarkDynamicSelect512(b *testing.B) { benchmarkDynamicSelect(b, 512) }
@@ -0,0 +1,209 @@
+package chapter3
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Event bus
+//
+// The Button in TestBroadcast announces a click with Clicked.Broadcast, which only wakes
+// the handlers already inside c.Wait. subscribe returns as soon as the handler goroutine
+// started, before it took the lock, so a click right after subscribe can go unnoticed,
+// and the click itself carries no data.
+//
+// Bus delivers typed events instead. Subscribe registers the handler before it returns,
+// so every event published afterwards reaches it. Every subscriber has its own queue and
+// goroutine, so a slow handler only delays itself; what happens when its queue is full is
+// decided by its Overflow policy.
+
+// Topic names a kind of event carrying values of type T. Topics with the same name but
+// different types are different topics.
+type Topic[T any] struct {
+	Name string
+}
+
+// NewTopic returns the topic called name.
+func NewTopic[T any](name string) Topic[T] {
+	return Topic[T]{Name: name}
+}
+
+// Overflow decides what a publisher does when a subscriber's queue is full.
+type Overflow int
+
+const (
+	// Block waits until the subscriber made room.
+	Block Overflow = iota
+	// DropNewest drops the event being published.
+	DropNewest
+	// DropOldest drops the oldest queued event to make room.
+	DropOldest
+)
+
+func (o Overflow) String() string {
+	switch o {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	}
+	return fmt.Sprintf("Overflow(%d)", int(o))
+}
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	// Queue is the number of events that can wait for the handler, at least 1.
+	Queue int
+
+	Overflow Overflow
+}
+
+// Bus routes published events to the subscribers of their topic. The zero value is ready
+// to use.
+type Bus struct {
+	mu     sync.RWMutex
+	topics map[interface{}][]interface{}
+}
+
+// Subscription is the handle of a subscribed handler.
+type Subscription struct {
+	unsubscribe func()
+	once        sync.Once
+	dropped     atomic.Int64
+
+	// stopped is closed once the delivery goroutine returned
+	stopped chan struct{}
+}
+
+// Unsubscribe stops the delivery to the handler without waiting for it: a call that is
+// running finishes, but the handler is not called again and the events still queued for
+// it are discarded. Since it does not wait, a handler may unsubscribe itself, as one-shot
+// handlers do. Wait for Done to know the handler returned.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(s.unsubscribe)
+}
+
+// Done returns a channel that is closed once the handler is unsubscribed and its last
+// call returned.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.stopped
+}
+
+// Dropped returns the number of events the overflow policy dropped.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+type subscriber[T any] struct {
+	sub      *Subscription
+	overflow Overflow
+	queue    chan T
+	quit     chan struct{}
+}
+
+// Subscribe calls fn, on a goroutine of its own, for every event published on topic from
+// now on.
+func Subscribe[T any](b *Bus, topic Topic[T], fn func(T), opts SubscribeOptions) *Subscription {
+	s := &subscriber[T]{
+		sub:      &Subscription{stopped: make(chan struct{})},
+		overflow: opts.Overflow,
+		queue:    make(chan T, max(opts.Queue, 1)),
+		quit:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.sub.stopped)
+		for {
+			select {
+			case <-s.quit:
+				return
+			case v := <-s.queue:
+				// select picks at random, a handler that unsubscribed must not get more
+				select {
+				case <-s.quit:
+					return
+				default:
+				}
+				fn(v)
+			}
+		}
+	}()
+
+	b.mu.Lock()
+	if b.topics == nil {
+		b.topics = make(map[interface{}][]interface{})
+	}
+	b.topics[topic] = append(b.topics[topic], s)
+	b.mu.Unlock()
+
+	s.sub.unsubscribe = func() {
+		b.mu.Lock()
+		subs := b.topics[topic]
+		for i, other := range subs {
+			if other == interface{}(s) {
+				b.topics[topic] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+		b.mu.Unlock()
+
+		close(s.quit)
+	}
+	return s.sub
+}
+
+// Publish queues v for every subscriber of topic and returns how many subscribers it was
+// queued for, not counting those whose policy dropped it. With the Block policy Publish
+// waits for room in the subscriber's queue.
+func Publish[T any](b *Bus, topic Topic[T], v T) int {
+	b.mu.RLock()
+	subs := b.topics[topic]
+	b.mu.RUnlock()
+
+	// subs is never modified in place, so it can be used without the lock
+	delivered := 0
+	for _, s := range subs {
+		if s.(*subscriber[T]).deliver(v) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+func (s *subscriber[T]) deliver(v T) bool {
+	switch s.overflow {
+	case DropNewest:
+		select {
+		case s.queue <- v:
+			return true
+		default:
+			s.sub.dropped.Add(1)
+			return false
+		}
+
+	case DropOldest:
+		for {
+			select {
+			case s.queue <- v:
+				return true
+			default:
+			}
+			select {
+			case <-s.queue:
+				s.sub.dropped.Add(1)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case s.queue <- v:
+			return true
+		case <-s.quit:
+			return false
+		}
+	}
+}
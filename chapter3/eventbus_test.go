@@ -0,0 +1,165 @@
+package chapter3
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Click struct {
+	X, Y int
+}
+
+func TestBusDeliversToEverySubscriber(t *testing.T) {
+	// TestBroadcast with a payload, and without the chance of missing the click
+	var bus Bus
+	clicked := NewTopic[Click]("button.clicked")
+
+	var clickRegistered sync.WaitGroup
+	clickRegistered.Add(3)
+	for _, handler := range []string{"Maximizing window.", "Displaying annoying dialog box!", "Mouse clicked."} {
+		handler := handler
+		sub := Subscribe(&bus, clicked, func(c Click) {
+			fmt.Printf("%s at %d,%d\n", handler, c.X, c.Y)
+			clickRegistered.Done()
+		}, SubscribeOptions{})
+		defer sub.Unsubscribe()
+	}
+
+	if n := Publish(&bus, clicked, Click{X: 10, Y: 20}); n != 3 {
+		t.Fatalf("published to %d subscribers, want 3", n)
+	}
+	clickRegistered.Wait()
+}
+
+func TestBusTopics(t *testing.T) {
+	var bus Bus
+	got := make(chan string, 10)
+
+	// same name, different type: different topics
+	ints, strings := NewTopic[int]("changed"), NewTopic[string]("changed")
+	intSub := Subscribe(&bus, ints, func(i int) { got <- fmt.Sprint("int ", i) }, SubscribeOptions{})
+	defer intSub.Unsubscribe()
+	stringSub := Subscribe(&bus, strings, func(s string) { got <- "string " + s }, SubscribeOptions{})
+
+	Publish(&bus, ints, 1)
+	if v := <-got; v != "int 1" {
+		t.Fatalf("got %q", v)
+	}
+	Publish(&bus, strings, "a")
+	if v := <-got; v != "string a" {
+		t.Fatalf("got %q", v)
+	}
+
+	stringSub.Unsubscribe()
+	stringSub.Unsubscribe()
+	if n := Publish(&bus, strings, "b"); n != 0 {
+		t.Fatalf("published to %d subscribers after Unsubscribe", n)
+	}
+}
+
+func TestBusOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		overflow  Overflow
+		delivered string
+	}{
+		{DropNewest, "[1 2 3]"},
+		{DropOldest, "[1 4 5]"},
+	} {
+		t.Run(tt.overflow.String(), func(t *testing.T) {
+			var bus Bus
+			topic := NewTopic[int]("numbers")
+
+			// the handler is stuck on 1 until release is closed, 2 more fit in the queue
+			release := make(chan struct{})
+			var mu sync.Mutex
+			var got []int
+			sub := Subscribe(&bus, topic, func(i int) {
+				<-release
+				mu.Lock()
+				got = append(got, i)
+				mu.Unlock()
+			}, SubscribeOptions{Queue: 2, Overflow: tt.overflow})
+
+			Publish(&bus, topic, 1)
+			time.Sleep(10 * time.Millisecond)
+			for i := 2; i <= 5; i++ {
+				Publish(&bus, topic, i)
+			}
+			close(release)
+			time.Sleep(10 * time.Millisecond)
+			sub.Unsubscribe()
+			<-sub.Done()
+
+			if fmt.Sprint(got) != tt.delivered || sub.Dropped() != 2 {
+				t.Fatalf("delivered %v, dropped %d; want %s and 2", got, sub.Dropped(), tt.delivered)
+			}
+		})
+	}
+}
+
+func TestBusBlockUnsubscribe(t *testing.T) {
+	var bus Bus
+	topic := NewTopic[int]("numbers")
+	release := make(chan struct{})
+	sub := Subscribe(&bus, topic, func(int) { <-release }, SubscribeOptions{Queue: 1})
+
+	published := make(chan int)
+	go func() {
+		n := 0
+		for i := 0; i < 3; i++ {
+			n += Publish(&bus, topic, i)
+		}
+		published <- n
+	}()
+
+	// the publisher blocks on the full queue until the subscriber goes away
+	time.Sleep(10 * time.Millisecond)
+	sub.Unsubscribe()
+	if n := <-published; n != 2 {
+		t.Fatalf("delivered %d events, want 2", n)
+	}
+
+	// Unsubscribe did not wait for the running call, Done does
+	select {
+	case <-sub.Done():
+		t.Fatal("Done closed while the handler was still running")
+	default:
+	}
+	close(release)
+	<-sub.Done()
+}
+
+func TestBusUnsubscribeFromHandler(t *testing.T) {
+	var bus Bus
+	topic := NewTopic[int]("numbers")
+
+	// a one-shot handler: it unsubscribes on the first event it sees
+	var sub *Subscription
+	subscribed := make(chan struct{})
+	calls := make(chan int, 3)
+	sub = Subscribe(&bus, topic, func(i int) {
+		<-subscribed
+		calls <- i
+		sub.Unsubscribe()
+	}, SubscribeOptions{Queue: 3})
+	close(subscribed)
+
+	for i := 0; i < 3; i++ {
+		Publish(&bus, topic, i)
+	}
+	if i := <-calls; i != 0 {
+		t.Fatalf("first call got %d, want 0", i)
+	}
+	// the handler returns from its own Unsubscribe, which closes Done
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("handler stuck in its own Unsubscribe")
+	}
+
+	if len(calls) != 0 {
+		t.Fatalf("handler called %d more times after unsubscribing", len(calls))
+	}
+}
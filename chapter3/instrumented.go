@@ -0,0 +1,183 @@
+package chapter3
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Instrumented mutex
+//
+// The greedy and the polite worker in main.go fight over sharedLock, but nothing tells how
+// long either waited for it or held it. InstrumentedMutex is a sync.Locker that can
+// answer that: with stats enabled it records wait and hold times in histograms and counts
+// the acquisitions that had to wait, and in debug mode it keeps the stack of the
+// goroutine holding it, to find out who sits on a lock that everybody waits for.
+//
+// Disabled, which is the zero value, it costs a few atomic loads per Lock and Unlock on top
+// of the sync.Mutex it wraps.
+
+// DurationHistogram counts durations in power-of-two buckets of nanoseconds. It is safe
+// for concurrent use.
+type DurationHistogram struct {
+	count   atomic.Int64
+	sum     atomic.Int64
+	buckets [64]atomic.Int64
+}
+
+// Observe adds d to the histogram.
+func (h *DurationHistogram) Observe(d time.Duration) {
+	ns := max(d.Nanoseconds(), 0)
+	h.count.Add(1)
+	h.sum.Add(ns)
+	h.buckets[bits.Len64(uint64(ns))].Add(1)
+}
+
+// Snapshot returns a copy of the counters.
+func (h *DurationHistogram) Snapshot() DurationSnapshot {
+	s := DurationSnapshot{Count: h.count.Load(), Sum: time.Duration(h.sum.Load())}
+	for i := range h.buckets {
+		s.Buckets[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// DurationSnapshot is a point-in-time copy of a DurationHistogram. Buckets[i] counts the
+// durations below 2^i ns that did not fit bucket i-1.
+type DurationSnapshot struct {
+	Count   int64
+	Sum     time.Duration
+	Buckets [64]int64
+}
+
+// Mean returns the average duration.
+func (s DurationSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding the q-th quantile (0 <= q <= 1),
+// ranked the same way as chapter4.HistogramSnapshot: q = 0 is the smallest observation's
+// bucket, q = 1 the largest one's.
+func (s DurationSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := max(int64(q*float64(s.Count)), 1)
+	var seen int64
+	for i, n := range s.Buckets {
+		if seen += n; seen >= rank {
+			return time.Duration(1<<i - 1)
+		}
+	}
+	return time.Duration(1<<63 - 1)
+}
+
+// LockStats are the counters of an InstrumentedMutex.
+type LockStats struct {
+	Wait DurationHistogram
+	Hold DurationHistogram
+
+	// Acquisitions counts every Lock, Contended those that found the mutex locked.
+	Acquisitions atomic.Int64
+	Contended    atomic.Int64
+}
+
+// InstrumentedMutex is a sync.Mutex that can record how it is used. The zero value is an
+// unlocked mutex with instrumentation disabled.
+type InstrumentedMutex struct {
+	mu    sync.Mutex
+	stats atomic.Pointer[LockStats]
+	debug atomic.Bool
+
+	// guarded by mu
+	acquired time.Time
+	// holder is read by other goroutines, so it is not guarded by mu
+	holder atomic.Pointer[[]byte]
+}
+
+// Instrument starts recording into stats, which may be shared by several mutexes. A nil
+// stats stops recording.
+func (m *InstrumentedMutex) Instrument(stats *LockStats) {
+	m.stats.Store(stats)
+}
+
+// SetDebug turns the recording of the holder's stack on or off. Capturing a stack on
+// every Lock is expensive, so debug mode is meant for hunting a specific problem.
+func (m *InstrumentedMutex) SetDebug(debug bool) {
+	m.debug.Store(debug)
+	if !debug {
+		m.holder.Store(nil)
+	}
+}
+
+// Lock locks m.
+func (m *InstrumentedMutex) Lock() {
+	s := m.stats.Load()
+	if s == nil {
+		m.mu.Lock()
+		m.locked(nil)
+		return
+	}
+
+	s.Acquisitions.Add(1)
+	if m.mu.TryLock() {
+		s.Wait.Observe(0)
+	} else {
+		s.Contended.Add(1)
+		start := time.Now()
+		m.mu.Lock()
+		s.Wait.Observe(time.Since(start))
+	}
+	m.locked(s)
+}
+
+// TryLock tries to lock m and reports whether it succeeded.
+func (m *InstrumentedMutex) TryLock() bool {
+	if !m.mu.TryLock() {
+		return false
+	}
+	s := m.stats.Load()
+	if s != nil {
+		s.Acquisitions.Add(1)
+		s.Wait.Observe(0)
+	}
+	m.locked(s)
+	return true
+}
+
+func (m *InstrumentedMutex) locked(s *LockStats) {
+	if s != nil {
+		m.acquired = time.Now()
+	}
+	if m.debug.Load() {
+		stack := make([]byte, 4096)
+		stack = stack[:runtime.Stack(stack, false)]
+		m.holder.Store(&stack)
+	}
+}
+
+// Unlock unlocks m.
+func (m *InstrumentedMutex) Unlock() {
+	if s := m.stats.Load(); s != nil && !m.acquired.IsZero() {
+		s.Hold.Observe(time.Since(m.acquired))
+	}
+	m.acquired = time.Time{}
+	if m.holder.Load() != nil {
+		m.holder.Store(nil)
+	}
+	m.mu.Unlock()
+}
+
+// Holder returns the stack of the goroutine holding m, or nil when m is not locked or debug
+// mode was off when it was locked.
+func (m *InstrumentedMutex) Holder() []byte {
+	if stack := m.holder.Load(); stack != nil {
+		return *stack
+	}
+	return nil
+}
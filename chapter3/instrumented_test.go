@@ -0,0 +1,163 @@
+package chapter3
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ sync.Locker = (*InstrumentedMutex)(nil)
+
+func TestInstrumentedMutex(t *testing.T) {
+	var stats LockStats
+	var m InstrumentedMutex
+	m.Instrument(&stats)
+
+	// like the greedy worker in main.go: one goroutine holds the lock for 10ms while
+	// another one waits for it
+	m.Lock()
+	waited := make(chan struct{})
+	go func() {
+		m.Lock()
+		m.Unlock()
+		close(waited)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Unlock()
+	<-waited
+
+	if stats.Acquisitions.Load() != 2 || stats.Contended.Load() != 1 {
+		t.Fatalf("%d acquisitions, %d contended; want 2 and 1",
+			stats.Acquisitions.Load(), stats.Contended.Load())
+	}
+	wait, hold := stats.Wait.Snapshot(), stats.Hold.Snapshot()
+	if wait.Count != 2 || wait.Quantile(1) < 5*time.Millisecond {
+		t.Errorf("wait histogram: %d observations, max %v", wait.Count, wait.Quantile(1))
+	}
+	if hold.Count != 2 || hold.Quantile(1) < 10*time.Millisecond || hold.Quantile(0) > time.Millisecond {
+		t.Errorf("hold histogram: %d observations, min %v, max %v", hold.Count, hold.Quantile(0), hold.Quantile(1))
+	}
+
+	// instrumentation can be turned off again
+	m.Instrument(nil)
+	m.Lock()
+	m.Unlock()
+	if stats.Acquisitions.Load() != 2 {
+		t.Fatal("disabled mutex still counts")
+	}
+}
+
+func lockAndWait(m *InstrumentedMutex, locked, release chan struct{}) {
+	m.Lock()
+	defer m.Unlock()
+	close(locked)
+	<-release
+}
+
+func TestInstrumentedMutexHolder(t *testing.T) {
+	var m InstrumentedMutex
+	m.SetDebug(true)
+
+	locked, release := make(chan struct{}), make(chan struct{})
+	go lockAndWait(&m, locked, release)
+	<-locked
+
+	if holder := m.Holder(); !bytes.Contains(holder, []byte("lockAndWait")) {
+		t.Fatalf("holder stack does not show the holder:\n%s", holder)
+	}
+	close(release)
+
+	m.Lock()
+	m.Unlock()
+	if m.Holder() != nil {
+		t.Fatal("unlocked mutex has a holder")
+	}
+	if !m.TryLock() {
+		t.Fatal("TryLock failed on an unlocked mutex")
+	}
+	m.Unlock()
+}
+
+func TestInstrumentedMutexConcurrent(t *testing.T) {
+	var stats LockStats
+	var m InstrumentedMutex
+	m.Instrument(&stats)
+	m.SetDebug(true)
+
+	count := 0
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Lock()
+				count++
+				m.Unlock()
+				m.Holder()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count != 8000 || stats.Acquisitions.Load() != 8000 || stats.Hold.Snapshot().Count != 8000 {
+		t.Fatalf("count %d, %d acquisitions", count, stats.Acquisitions.Load())
+	}
+}
+
+func BenchmarkMutex(b *testing.B) {
+	var m sync.Mutex
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.Lock()
+			m.Unlock()
+		}
+	})
+}
+
+func benchmarkInstrumentedMutex(b *testing.B, stats *LockStats, debug bool) {
+	var m InstrumentedMutex
+	m.Instrument(stats)
+	m.SetDebug(debug)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.Lock()
+			m.Unlock()
+		}
+	})
+}
+
+func BenchmarkInstrumentedMutexDisabled(b *testing.B) { benchmarkInstrumentedMutex(b, nil, false) }
+func BenchmarkInstrumentedMutexStats(b *testing.B) {
+	benchmarkInstrumentedMutex(b, &LockStats{}, false)
+}
+func BenchmarkInstrumentedMutexDebug(b *testing.B) { benchmarkInstrumentedMutex(b, &LockStats{}, true) }
+
+func TestDurationHistogramQuantile(t *testing.T) {
+	var h DurationHistogram
+	if q := h.Snapshot().Quantile(0.5); q != 0 {
+		t.Errorf("empty p50 = %v, want 0", q)
+	}
+
+	for i := 0; i < 3; i++ {
+		h.Observe(time.Microsecond)
+	}
+	h.Observe(time.Second)
+	s := h.Snapshot()
+
+	// 1µs falls in the bucket up to 1023ns, 1s in the one up to 2^30-1ns
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 1023},
+		{0.5, 1023},
+		{0.75, 1023},
+		{1, 1<<30 - 1},
+	} {
+		if got := s.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package chapter3
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lock contention benchmarks
+//
+// TestRWMutex compares one writer against a growing number of readers, for sync.Mutex and
+// sync.RWMutex only. RunLockBench measures any sync.Locker the same way, with the knobs
+// that decide how a lock behaves under contention:
+//
+//   - the share of operations that only read, and take the reader lock
+//   - how long the lock is held, spent spinning so the scheduler is not involved
+//   - the number of goroutines, from 1 up to 2^k in LockBenchMatrix
+//   - the number of keys the operations are spread over, which only matters to locks
+//     that guard data by key, like StripedLock
+//
+// The results can be written as CSV or JSON to plot them. cmd/lockbench runs the matrix
+// from the command line.
+
+// LockFactory returns a fresh lock: the Locker writers use for a key, and the one readers
+// use. Locks that guard all data at once return the same Locker for every key, locks
+// without a read mode the same Locker for writers and readers.
+type LockFactory func() (writer, reader func(key uint64) sync.Locker)
+
+// SingleLock is the LockFactory of a lock that guards all keys: newLock returns the
+// writer and reader Locker of a fresh lock.
+func SingleLock(newLock func() (writer, reader sync.Locker)) LockFactory {
+	return func() (func(uint64) sync.Locker, func(uint64) sync.Locker) {
+		writer, reader := newLock()
+		return func(uint64) sync.Locker { return writer }, func(uint64) sync.Locker { return reader }
+	}
+}
+
+// StandardLocks returns the locks of the sync package by name.
+func StandardLocks() map[string]LockFactory {
+	return map[string]LockFactory{
+		"mutex": SingleLock(func() (sync.Locker, sync.Locker) {
+			var m sync.Mutex
+			return &m, &m
+		}),
+		"rwmutex": SingleLock(func() (sync.Locker, sync.Locker) {
+			var m sync.RWMutex
+			return &m, m.RLocker()
+		}),
+	}
+}
+
+// Locks returns StandardLocks and the locks of this package by name: "instrumented" is an
+// InstrumentedMutex recording its stats, "striped" a StripedLock with 64 stripes.
+func Locks() map[string]LockFactory {
+	locks := StandardLocks()
+	locks["instrumented"] = SingleLock(func() (sync.Locker, sync.Locker) {
+		var m InstrumentedMutex
+		m.Instrument(&LockStats{})
+		return &m, &m
+	})
+	locks["striped"] = func() (func(uint64) sync.Locker, func(uint64) sync.Locker) {
+		l := NewStripedLock[uint64](64, nil)
+		return l.Locker, l.Locker
+	}
+	return locks
+}
+
+// LockBenchCase describes one benchmark run.
+type LockBenchCase struct {
+	Lock            string        `json:"lock"`
+	Goroutines      int           `json:"goroutines"`
+	ReadRatio       float64       `json:"read_ratio"`
+	CriticalSection time.Duration `json:"critical_section_ns"`
+	// Keys is the number of keys the operations pick from at random, at least 1.
+	Keys int `json:"keys"`
+	// OpsPerGoroutine is the number of lock acquisitions of every goroutine.
+	OpsPerGoroutine int `json:"ops_per_goroutine"`
+}
+
+// LockBenchResult is the outcome of a LockBenchCase.
+type LockBenchResult struct {
+	LockBenchCase
+	Elapsed   time.Duration `json:"elapsed_ns"`
+	NsPerOp   float64       `json:"ns_per_op"`
+	OpsPerSec float64       `json:"ops_per_sec"`
+}
+
+// RunLockBench runs c against a lock made by newLock.
+func RunLockBench(newLock LockFactory, c LockBenchCase) LockBenchResult {
+	writer, reader := newLock()
+	goroutines := max(c.Goroutines, 1)
+	keys := uint64(max(c.Keys, 1))
+
+	var start, finished sync.WaitGroup
+	start.Add(1)
+	finished.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			defer finished.Done()
+			// a fixed seed per goroutine makes runs comparable across locks
+			rnd := rand.New(rand.NewPCG(uint64(g), uint64(c.OpsPerGoroutine)))
+			start.Wait()
+
+			for i := 0; i < c.OpsPerGoroutine; i++ {
+				lockFor := writer
+				if rnd.Float64() < c.ReadRatio {
+					lockFor = reader
+				}
+				l := lockFor(rnd.Uint64N(keys))
+				l.Lock()
+				spin(c.CriticalSection)
+				l.Unlock()
+			}
+		}(g)
+	}
+
+	begin := time.Now()
+	start.Done()
+	finished.Wait()
+	elapsed := time.Since(begin)
+
+	ops := float64(goroutines * c.OpsPerGoroutine)
+	r := LockBenchResult{LockBenchCase: c, Elapsed: elapsed}
+	if ops > 0 {
+		r.NsPerOp = float64(elapsed.Nanoseconds()) / ops
+		r.OpsPerSec = ops / elapsed.Seconds()
+	}
+	return r
+}
+
+// spin busy-waits for d. time.Sleep would hand the goroutine to the scheduler, which
+// measures the scheduler rather than the lock.
+func spin(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	for start := time.Now(); time.Since(start) < d; {
+	}
+}
+
+// LockBenchMatrix runs every combination of lock, read ratio, critical section and
+// goroutine count 1, 2, 4, ... 2^maxLog2 over the same number of keys, locks sorted by
+// name.
+func LockBenchMatrix(
+	locks map[string]LockFactory,
+	maxLog2 int,
+	readRatios []float64,
+	sections []time.Duration,
+	keys int,
+	opsPerGoroutine int,
+) []LockBenchResult {
+	names := make([]string, 0, len(locks))
+	for name := range locks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var results []LockBenchResult
+	for _, name := range names {
+		for _, ratio := range readRatios {
+			for _, section := range sections {
+				for k := 0; k <= maxLog2; k++ {
+					results = append(results, RunLockBench(locks[name], LockBenchCase{
+						Lock:            name,
+						Goroutines:      1 << k,
+						ReadRatio:       ratio,
+						CriticalSection: section,
+						Keys:            keys,
+						OpsPerGoroutine: opsPerGoroutine,
+					}))
+				}
+			}
+		}
+	}
+	return results
+}
+
+// WriteLockBenchCSV writes the results as CSV with a header line, durations in
+// nanoseconds.
+func WriteLockBenchCSV(w io.Writer, results []LockBenchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"lock", "goroutines", "read_ratio", "critical_section_ns", "keys",
+		"ops_per_goroutine", "elapsed_ns", "ns_per_op", "ops_per_sec"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.Lock,
+			strconv.Itoa(r.Goroutines),
+			strconv.FormatFloat(r.ReadRatio, 'g', -1, 64),
+			strconv.FormatInt(r.CriticalSection.Nanoseconds(), 10),
+			strconv.Itoa(max(r.Keys, 1)),
+			strconv.Itoa(r.OpsPerGoroutine),
+			strconv.FormatInt(r.Elapsed.Nanoseconds(), 10),
+			strconv.FormatFloat(r.NsPerOp, 'f', 2, 64),
+			strconv.FormatFloat(r.OpsPerSec, 'f', 0, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteLockBenchJSON writes the results as a JSON array, durations in nanoseconds.
+func WriteLockBenchJSON(w io.Writer, results []LockBenchResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
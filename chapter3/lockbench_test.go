@@ -0,0 +1,100 @@
+package chapter3
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLock checks mutual exclusion of the writers while the benchmark runs. Every
+// run gets a lock of its own, they all report to the same violated flag.
+type countingLock struct {
+	sync.Mutex
+	holders  int
+	violated *atomic.Bool
+}
+
+func (l *countingLock) Lock() {
+	l.Mutex.Lock()
+	l.holders++
+	if l.holders != 1 {
+		l.violated.Store(true)
+	}
+}
+
+func (l *countingLock) Unlock() {
+	l.holders--
+	l.Mutex.Unlock()
+}
+
+func TestLockBenchMatrix(t *testing.T) {
+	var violated atomic.Bool
+	var runs atomic.Int32
+	locks := StandardLocks()
+	locks["counting"] = SingleLock(func() (sync.Locker, sync.Locker) {
+		runs.Add(1)
+		l := &countingLock{violated: &violated}
+		return l, l
+	})
+
+	results := LockBenchMatrix(locks, 2, []float64{0, 0.9}, []time.Duration{0, time.Microsecond}, 16, 100)
+	// 3 locks x 2 ratios x 2 sections x 3 goroutine counts
+	if len(results) != 36 {
+		t.Fatalf("%d results, want 36", len(results))
+	}
+	if runs.Load() != 12 {
+		t.Fatalf("counting lock made for %d runs, want 12", runs.Load())
+	}
+	if violated.Load() {
+		t.Fatal("two goroutines held the lock at once")
+	}
+	if r := results[len(results)-1]; r.Lock != "rwmutex" || r.Goroutines != 4 || r.NsPerOp <= 0 {
+		t.Fatalf("last result %+v", r)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteLockBenchCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 37 || rows[0][0] != "lock" || rows[1][0] != "counting" {
+		t.Fatalf("CSV: %d rows, %v", len(rows), err)
+	}
+
+	buf.Reset()
+	if err := WriteLockBenchJSON(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []LockBenchResult
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 36 {
+		t.Fatalf("JSON: %d results, %v", len(decoded), err)
+	}
+	if decoded[3].CriticalSection != time.Microsecond {
+		t.Fatalf("critical section decoded as %v", decoded[3].CriticalSection)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	locks := Locks()
+	for _, name := range []string{"mutex", "rwmutex", "instrumented", "striped"} {
+		newLock, ok := locks[name]
+		if !ok {
+			t.Errorf("Locks() has no %s", name)
+			continue
+		}
+		r := RunLockBench(newLock, LockBenchCase{Lock: name, Goroutines: 4, ReadRatio: 0.5, Keys: 64, OpsPerGoroutine: 100})
+		if r.NsPerOp <= 0 {
+			t.Errorf("%s: %+v", name, r)
+		}
+	}
+
+	// equal keys share a stripe, so the striped lock still excludes writers of one key
+	writer, _ := locks["striped"]()
+	if writer(7) != writer(7) {
+		t.Error("striped lock returned different locks for one key")
+	}
+}
@@ -0,0 +1,158 @@
+package chapter3
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Once with a result
+//
+// TestIncrement2 shows that sync.Once runs one function, once, whatever happens in it. For
+// a lazy initializer like connectToService that is not enough: the connection is the
+// result, dialing can fail, and a failed dial should be tried again instead of being
+// remembered forever. OnceValue calls its function until it succeeded once:
+//
+//   - callers that arrive while a call is running wait for that call and share its result
+//   - after a failure, the next caller tries again, or with a Backoff, the first caller
+//     after the backoff expired; callers in between get the error of the failed call
+//   - Reset forgets the result, so the next caller calls the function again
+
+// OnceOptions configures the retries of a OnceValue.
+type OnceOptions struct {
+	// Backoff is how long after a failed call the next call may start, doubled for every
+	// failure in a row. Zero retries right away.
+	Backoff time.Duration
+
+	// MaxBackoff caps the doubled backoff. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// OnceValue calls a function until it succeeded, and then returns its value. It is safe
+// for concurrent use.
+type OnceValue[T any] struct {
+	fn   func() (T, error)
+	opts OnceOptions
+
+	mu       sync.Mutex
+	done     bool
+	value    T
+	call     *onceCall[T]
+	failures int
+	lastErr  error
+	retryAt  time.Time
+	// generation is bumped by Reset, so a call started before it does not store its result
+	generation int
+}
+
+type onceCall[T any] struct {
+	finished chan struct{}
+	value    T
+	err      error
+}
+
+// NewOnceValue returns a OnceValue for fn.
+func NewOnceValue[T any](fn func() (T, error), opts OnceOptions) *OnceValue[T] {
+	return &OnceValue[T]{fn: fn, opts: opts}
+}
+
+// Get returns the value of the first successful call of the function, calling it if
+// there was none yet.
+func (o *OnceValue[T]) Get() (T, error) {
+	o.mu.Lock()
+	if o.done {
+		defer o.mu.Unlock()
+		return o.value, nil
+	}
+	if c := o.call; c != nil {
+		o.mu.Unlock()
+		<-c.finished
+		return c.value, c.err
+	}
+	if o.failures > 0 && time.Now().Before(o.retryAt) {
+		defer o.mu.Unlock()
+		var zero T
+		return zero, o.lastErr
+	}
+
+	c := &onceCall[T]{finished: make(chan struct{})}
+	o.call = c
+	generation := o.generation
+	o.mu.Unlock()
+
+	completed := false
+	defer func() {
+		if !completed {
+			// fn panicked: let the waiters go, the panic goes on in this goroutine
+			r := recover()
+			c.err = fmt.Errorf("chapter3: once function panicked: %v", r)
+			o.finish(c, generation)
+			panic(r)
+		}
+	}()
+	c.value, c.err = o.fn()
+	completed = true
+
+	o.finish(c, generation)
+	return c.value, c.err
+}
+
+func (o *OnceValue[T]) finish(c *onceCall[T], generation int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	defer close(c.finished)
+
+	if o.generation != generation {
+		return
+	}
+	o.call = nil
+	if c.err == nil {
+		o.done, o.value = true, c.value
+		o.failures, o.lastErr = 0, nil
+		return
+	}
+
+	o.failures++
+	o.lastErr = c.err
+	if o.opts.Backoff > 0 {
+		o.retryAt = time.Now().Add(o.backoff(o.failures))
+	}
+}
+
+// backoff returns the wait after the given number of failures in a row: Backoff doubled
+// for every failure after the first, up to MaxBackoff, or the largest duration without
+// one. It stops doubling before the shift could overflow.
+func (o *OnceValue[T]) backoff(failures int) time.Duration {
+	limit := o.opts.MaxBackoff
+	if limit <= 0 {
+		limit = 1<<63 - 1
+	}
+	backoff := min(o.opts.Backoff, limit)
+	for i := 1; i < failures && backoff < limit; i++ {
+		if backoff > limit/2 {
+			return limit
+		}
+		backoff *= 2
+	}
+	return backoff
+}
+
+// Reset forgets the value and any failures, so the next Get calls the function again. A
+// call running during Reset still returns its result to its callers, but it is not kept.
+func (o *OnceValue[T]) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var zero T
+	o.done, o.value = false, zero
+	o.call = nil
+	o.failures, o.lastErr = 0, nil
+	o.generation++
+}
+
+// Done reports whether a call succeeded and its value is kept.
+func (o *OnceValue[T]) Done() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.done
+}
@@ -0,0 +1,151 @@
+package chapter3
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errDial = errors.New("cannot dial")
+
+func TestOnceValueShared(t *testing.T) {
+	// TestIncrement, but the 100 callers also get the value
+	var calls atomic.Int32
+	dial := NewOnceValue(func() (int, error) {
+		calls.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return 42, nil
+	}, OnceOptions{})
+
+	var callers sync.WaitGroup
+	callers.Add(100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			defer callers.Done()
+			if v, err := dial.Get(); v != 42 || err != nil {
+				t.Errorf("Get = %d, %v", v, err)
+			}
+		}()
+	}
+	callers.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("function called %d times", calls.Load())
+	}
+}
+
+func TestOnceValueRetry(t *testing.T) {
+	var calls atomic.Int32
+	dial := NewOnceValue(func() (string, error) {
+		if calls.Add(1) < 3 {
+			return "", errDial
+		}
+		return "conn", nil
+	}, OnceOptions{})
+
+	for i := 1; i <= 2; i++ {
+		if _, err := dial.Get(); err != errDial {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if v, err := dial.Get(); v != "conn" || err != nil {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	dial.Get()
+	if calls.Load() != 3 || !dial.Done() {
+		t.Fatalf("function called %d times", calls.Load())
+	}
+
+	dial.Reset()
+	if dial.Done() {
+		t.Fatal("Done after Reset")
+	}
+	dial.Get()
+	if calls.Load() != 4 {
+		t.Fatal("Get after Reset did not call the function")
+	}
+}
+
+func TestOnceValueBackoff(t *testing.T) {
+	var calls atomic.Int32
+	dial := NewOnceValue(func() (int, error) {
+		calls.Add(1)
+		return 0, errDial
+	}, OnceOptions{Backoff: 20 * time.Millisecond})
+
+	dial.Get()
+	if _, err := dial.Get(); err != errDial || calls.Load() != 1 {
+		t.Fatalf("Get during the backoff: %v after %d calls", err, calls.Load())
+	}
+	time.Sleep(25 * time.Millisecond)
+	dial.Get()
+	if calls.Load() != 2 {
+		t.Fatalf("function called %d times after the backoff, want 2", calls.Load())
+	}
+
+	// the second failure doubles the backoff to 40ms
+	time.Sleep(25 * time.Millisecond)
+	dial.Get()
+	if calls.Load() != 2 {
+		t.Fatal("backoff was not doubled")
+	}
+}
+
+func TestOnceValueLargeBackoff(t *testing.T) {
+	fail := func() (int, error) { return 0, errDial }
+
+	// 10s doubled 30 times overflows a time.Duration, the backoff must stay positive
+	uncapped := NewOnceValue(fail, OnceOptions{Backoff: 10 * time.Second})
+	for _, failures := range []int{1, 2, 30, 31, 100} {
+		if b := uncapped.backoff(failures); b < 10*time.Second {
+			t.Errorf("backoff after %d failures = %v", failures, b)
+		}
+	}
+
+	capped := NewOnceValue(fail, OnceOptions{Backoff: 10 * time.Second, MaxBackoff: time.Minute})
+	for failures, want := range map[int]time.Duration{
+		1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 100: time.Minute,
+	} {
+		if b := capped.backoff(failures); b != want {
+			t.Errorf("capped backoff after %d failures = %v, want %v", failures, b, want)
+		}
+	}
+
+	// and a failed call really waits
+	uncapped.Get()
+	uncapped.Get()
+	uncapped.mu.Lock()
+	failures := uncapped.failures
+	uncapped.mu.Unlock()
+	if failures != 1 {
+		t.Fatalf("%d calls during a 10s backoff, want 1", failures)
+	}
+}
+
+func TestOnceValuePanic(t *testing.T) {
+	release := make(chan struct{})
+	dial := NewOnceValue(func() (int, error) {
+		<-release
+		panic("boom")
+	}, OnceOptions{})
+
+	go func() {
+		defer func() { recover() }()
+		dial.Get()
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	waiter := make(chan error)
+	go func() {
+		_, err := dial.Get()
+		waiter <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	close(release)
+
+	if err := <-waiter; err == nil {
+		t.Fatal("waiter of a panicking call got no error")
+	}
+}
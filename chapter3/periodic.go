@@ -0,0 +1,153 @@
+package chapter3
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Periodic work
+//
+// TestSelectV4 polls done, does some work and sleeps, so a stop is only noticed once the
+// sleep is over and the period drifts by however long the work took. Periodic runs work
+// on a schedule instead:
+//
+//   - FixedRate: runs start every Interval, measured from the first run. A run that takes
+//     longer than Interval makes the runner skip the ticks it missed instead of running
+//     them back to back, and those skipped ticks are counted.
+//   - FixedDelay: every run starts Interval after the previous one finished.
+//
+// The wait between runs is a select on a timer and on the stop signal, so a stop is
+// noticed right away; the work itself gets a done channel to stop early.
+
+// Schedule decides how Periodic spaces its runs.
+type Schedule int
+
+const (
+	FixedRate Schedule = iota
+	FixedDelay
+)
+
+// PeriodicOptions configures a Periodic.
+type PeriodicOptions struct {
+	Interval time.Duration
+	Schedule Schedule
+
+	// Jitter, when positive, delays every run by a random duration below Jitter, so
+	// runners started together do not run in lockstep.
+	Jitter time.Duration
+
+	// Immediate starts the first run right away instead of after one Interval.
+	Immediate bool
+
+	// OnOverrun is called after a FixedRate run that overran, with the number of ticks
+	// it made the runner skip.
+	OnOverrun func(skipped int)
+}
+
+// Periodic is a running periodic work loop.
+type Periodic struct {
+	opts     PeriodicOptions
+	work     func(done <-chan interface{})
+	quit     chan interface{}
+	quitOnce sync.Once
+	finished chan struct{}
+	runs     atomic.Int64
+	skipped  atomic.Int64
+}
+
+// RunPeriodic starts calling work on the schedule of opts, until done is closed or Stop
+// is called. The done channel passed to work is closed on either.
+func RunPeriodic(done <-chan interface{}, work func(done <-chan interface{}), opts PeriodicOptions) *Periodic {
+	p := &Periodic{
+		opts:     opts,
+		work:     work,
+		quit:     make(chan interface{}),
+		finished: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-done:
+			p.stop()
+		case <-p.quit:
+		}
+	}()
+	go p.loop()
+	return p
+}
+
+func (p *Periodic) loop() {
+	defer close(p.finished)
+
+	start := time.Now()
+	next := start
+	if !p.opts.Immediate {
+		next = start.Add(p.opts.Interval)
+	}
+
+	t := time.NewTimer(p.wait(next))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-t.C:
+		}
+
+		p.work(p.quit)
+		p.runs.Add(1)
+
+		now := time.Now()
+		switch {
+		case p.opts.Schedule == FixedDelay || p.opts.Interval <= 0:
+			next = now.Add(p.opts.Interval)
+		default:
+			next = next.Add(p.opts.Interval)
+			if now.After(next) {
+				skipped := int(now.Sub(next)/p.opts.Interval) + 1
+				next = next.Add(time.Duration(skipped) * p.opts.Interval)
+				p.skipped.Add(int64(skipped))
+				if p.opts.OnOverrun != nil {
+					p.opts.OnOverrun(skipped)
+				}
+			}
+		}
+		t.Reset(p.wait(next))
+	}
+}
+
+// wait returns how long to wait for the run at next, jitter included.
+func (p *Periodic) wait(next time.Time) time.Duration {
+	d := time.Until(next)
+	if p.opts.Jitter > 0 {
+		d += rand.N(p.opts.Jitter)
+	}
+	return max(d, 0)
+}
+
+// Stop stops the runner and waits for a run in progress to return.
+func (p *Periodic) Stop() {
+	p.stop()
+	<-p.finished
+}
+
+func (p *Periodic) stop() {
+	p.quitOnce.Do(func() { close(p.quit) })
+}
+
+// Done is closed once the runner stopped.
+func (p *Periodic) Done() <-chan struct{} {
+	return p.finished
+}
+
+// Runs returns the number of finished runs.
+func (p *Periodic) Runs() int64 {
+	return p.runs.Load()
+}
+
+// Skipped returns the number of FixedRate ticks skipped because a run overran.
+func (p *Periodic) Skipped() int64 {
+	return p.skipped.Load()
+}
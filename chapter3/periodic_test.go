@@ -0,0 +1,100 @@
+package chapter3
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeriodicFixedRate(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+
+	p := RunPeriodic(nil, func(done <-chan interface{}) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+	}, PeriodicOptions{Interval: 10 * time.Millisecond, Immediate: true})
+
+	time.Sleep(55 * time.Millisecond)
+	p.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// a slow scheduler may make the runner skip a tick, but not drift
+	if ticks := int64(len(starts)) + p.Skipped(); ticks < 5 || ticks > 7 {
+		t.Fatalf("%d runs and %d skipped ticks in 55ms at a 10ms rate", len(starts), p.Skipped())
+	}
+}
+
+func TestPeriodicOverrun(t *testing.T) {
+	var reported atomic.Int64
+	var runs atomic.Int64
+	p := RunPeriodic(nil, func(done <-chan interface{}) {
+		// the first run takes 3.5 intervals, the others are quick
+		if runs.Add(1) == 1 {
+			time.Sleep(35 * time.Millisecond)
+		}
+	}, PeriodicOptions{
+		Interval:  10 * time.Millisecond,
+		Immediate: true,
+		OnOverrun: func(skipped int) { reported.Add(int64(skipped)) },
+	})
+
+	time.Sleep(60 * time.Millisecond)
+	p.Stop()
+
+	if p.Skipped() < 3 || reported.Load() != p.Skipped() {
+		t.Fatalf("skipped %d ticks, reported %d, want at least 3", p.Skipped(), reported.Load())
+	}
+}
+
+func TestPeriodicFixedDelay(t *testing.T) {
+	var last time.Time
+	var gaps []time.Duration
+	p := RunPeriodic(nil, func(done <-chan interface{}) {
+		if !last.IsZero() {
+			gaps = append(gaps, time.Since(last))
+		}
+		time.Sleep(5 * time.Millisecond)
+		last = time.Now()
+	}, PeriodicOptions{Interval: 10 * time.Millisecond, Schedule: FixedDelay, Jitter: time.Millisecond})
+
+	time.Sleep(70 * time.Millisecond)
+	p.Stop()
+
+	// Stop waits for the loop, so reading gaps is safe here
+	if len(gaps) == 0 {
+		t.Fatal("no runs")
+	}
+	for _, gap := range gaps {
+		if gap < 10*time.Millisecond {
+			t.Errorf("run started %v after the previous one finished", gap)
+		}
+	}
+}
+
+func TestPeriodicStop(t *testing.T) {
+	done := make(chan interface{})
+	var stopped atomic.Bool
+	p := RunPeriodic(done, func(done <-chan interface{}) {
+		<-done
+		stopped.Store(true)
+	}, PeriodicOptions{Interval: time.Hour, Immediate: true})
+
+	time.Sleep(5 * time.Millisecond)
+	start := time.Now()
+	close(done)
+	<-p.Done()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond || !stopped.Load() {
+		t.Fatalf("runner took %v to stop", elapsed)
+	}
+
+	// without Immediate nothing runs during the first hour, and Stop does not wait for it
+	p = RunPeriodic(nil, func(done <-chan interface{}) {}, PeriodicOptions{Interval: time.Hour})
+	p.Stop()
+	if p.Runs() != 0 {
+		t.Fatalf("%d runs before the first interval", p.Runs())
+	}
+}
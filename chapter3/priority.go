@@ -0,0 +1,184 @@
+package chapter3
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+)
+
+// Priority select
+//
+// TestSelectV2 shows that select picks uniformly among the ready cases, which is fair but
+// means a control message waits behind data as often as not. PrioritySelect receives from
+// a list of channels in priority order instead, the first channel being the most
+// important:
+//
+//   - StrictPriority: a ready channel always wins over every channel after it
+//   - WeightedPriority: a ready channel wins with a chance proportional to its weight
+//
+// Strict priority can starve the later channels for as long as the earlier ones have
+// values. MaxSkips bounds that: a channel passed over MaxSkips times in a row is tried
+// first on the next receive.
+
+// PriorityMode decides how PrioritySelect picks among ready channels.
+type PriorityMode int
+
+const (
+	StrictPriority PriorityMode = iota
+	WeightedPriority
+)
+
+func (m PriorityMode) String() string {
+	switch m {
+	case StrictPriority:
+		return "strict"
+	case WeightedPriority:
+		return "weighted"
+	}
+	return fmt.Sprintf("PriorityMode(%d)", int(m))
+}
+
+// PriorityOptions configures a PrioritySelect.
+type PriorityOptions struct {
+	Mode PriorityMode
+
+	// Weights holds one weight per input for WeightedPriority. Missing or non-positive
+	// weights count as 1.
+	Weights []int
+
+	// MaxSkips is how many receives in a row an input may lose before it is tried first.
+	// Zero turns starvation protection off.
+	MaxSkips int
+}
+
+// PrioritySelect receives from several channels, preferring the earlier ones. It is not
+// safe for concurrent use.
+type PrioritySelect[T any] struct {
+	opts    PriorityOptions
+	inputs  []<-chan T
+	weights []int
+	skipped []int
+	order   []int
+	cases   []reflect.SelectCase
+	open    int
+}
+
+// NewPrioritySelect returns a PrioritySelect over inputs, the highest priority first.
+func NewPrioritySelect[T any](opts PriorityOptions, inputs ...<-chan T) *PrioritySelect[T] {
+	s := &PrioritySelect[T]{
+		opts:    opts,
+		inputs:  append([]<-chan T(nil), inputs...),
+		weights: make([]int, len(inputs)),
+		skipped: make([]int, len(inputs)),
+		order:   make([]int, len(inputs)),
+		cases:   make([]reflect.SelectCase, len(inputs)+1),
+		open:    len(inputs),
+	}
+	for i, in := range inputs {
+		s.weights[i] = 1
+		if i < len(opts.Weights) && opts.Weights[i] > 0 {
+			s.weights[i] = opts.Weights[i]
+		}
+		s.cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in)}
+	}
+	return s
+}
+
+// Recv returns the next value and the index of the input it came from. Closed inputs are
+// skipped; ok is false once done is closed or every input is.
+func (s *PrioritySelect[T]) Recv(done <-chan interface{}) (value T, index int, ok bool) {
+	for s.open > 0 {
+		select {
+		case <-done:
+			return value, -1, false
+		default:
+		}
+
+		for _, i := range s.pickOrder() {
+			select {
+			case v, open := <-s.inputs[i]:
+				if !open {
+					s.closeInput(i)
+					continue
+				}
+				s.served(i)
+				return v, i, true
+			default:
+				// empty, so not starving either
+				s.skipped[i] = 0
+			}
+		}
+
+		if s.open == 0 {
+			break
+		}
+
+		// nothing ready: wait for whichever input has a value first
+		s.cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)}
+		chosen, v, open := reflect.Select(s.cases)
+		if chosen == 0 {
+			return value, -1, false
+		}
+		i := chosen - 1
+		if !open {
+			s.closeInput(i)
+			continue
+		}
+		s.served(i)
+		value, _ = v.Interface().(T)
+		return value, i, true
+	}
+	return value, -1, false
+}
+
+// pickOrder returns the order in which the inputs are tried: starving inputs first, then
+// by priority or by weighted draw.
+func (s *PrioritySelect[T]) pickOrder() []int {
+	order := s.order[:0]
+	for i := range s.inputs {
+		if s.inputs[i] != nil && s.opts.MaxSkips > 0 && s.skipped[i] >= s.opts.MaxSkips {
+			order = append(order, i)
+		}
+	}
+	starving := len(order)
+	for i := range s.inputs {
+		if s.inputs[i] != nil && (s.opts.MaxSkips <= 0 || s.skipped[i] < s.opts.MaxSkips) {
+			order = append(order, i)
+		}
+	}
+
+	if s.opts.Mode == WeightedPriority {
+		// weighted draw without replacement over the inputs that are not starving
+		rest := order[starving:]
+		for k := range rest {
+			total := 0
+			for _, i := range rest[k:] {
+				total += s.weights[i]
+			}
+			n := rand.IntN(total)
+			for j, i := range rest[k:] {
+				if n -= s.weights[i]; n < 0 {
+					rest[k], rest[k+j] = rest[k+j], rest[k]
+					break
+				}
+			}
+		}
+	}
+	return order
+}
+
+func (s *PrioritySelect[T]) served(index int) {
+	for i := range s.skipped {
+		if s.inputs[i] != nil {
+			s.skipped[i]++
+		}
+	}
+	s.skipped[index] = 0
+}
+
+func (s *PrioritySelect[T]) closeInput(i int) {
+	s.inputs[i] = nil
+	// a nil channel never fires in reflect.Select either
+	s.cases[i+1].Chan = reflect.ValueOf((<-chan T)(nil))
+	s.open--
+}
@@ -0,0 +1,103 @@
+package chapter3
+
+import (
+	"fmt"
+	"testing"
+)
+
+// filled returns a buffered channel holding n values.
+func filled(n int) <-chan int {
+	c := make(chan int, n)
+	for i := 0; i < n; i++ {
+		c <- i
+	}
+	return c
+}
+
+// distribution receives n values from two always-ready inputs and counts per input.
+func distribution(t *testing.T, opts PriorityOptions, n int) [2]int {
+	t.Helper()
+	done := make(chan interface{})
+	defer close(done)
+
+	s := NewPrioritySelect(opts, filled(n), filled(n))
+	var counts [2]int
+	for i := 0; i < n; i++ {
+		_, index, ok := s.Recv(done)
+		if !ok {
+			t.Fatal("Recv failed with values left")
+		}
+		counts[index]++
+	}
+	fmt.Printf("%v skips=%d weights=%v: high %d, low %d\n",
+		opts.Mode, opts.MaxSkips, opts.Weights, counts[0], counts[1])
+	return counts
+}
+
+func TestPrioritySelectStrict(t *testing.T) {
+	// Unlike TestSelectV2, the first channel wins every time
+	if counts := distribution(t, PriorityOptions{}, 4000); counts[0] != 4000 {
+		t.Errorf("strict priority served low %d times", counts[1])
+	}
+
+	// ... unless the second one has been passed over 3 times in a row
+	counts := distribution(t, PriorityOptions{MaxSkips: 3}, 4000)
+	if counts[1] != 1000 {
+		t.Errorf("starvation protection served low %d times, want 1000", counts[1])
+	}
+}
+
+func TestPrioritySelectWeighted(t *testing.T) {
+	counts := distribution(t, PriorityOptions{Mode: WeightedPriority, Weights: []int{3, 1}}, 4000)
+	if share := float64(counts[0]) / 4000; share < 0.7 || share > 0.8 {
+		t.Errorf("high got %.2f of the values, want about 0.75", share)
+	}
+
+	// with starvation protection the low input gets at least one value in 3
+	counts = distribution(t, PriorityOptions{Mode: WeightedPriority, Weights: []int{9, 1}, MaxSkips: 2}, 4000)
+	if counts[1] < 4000/3 {
+		t.Errorf("low got %d values, want at least %d", counts[1], 4000/3)
+	}
+}
+
+func TestPrioritySelectClosed(t *testing.T) {
+	done := make(chan interface{})
+	high := make(chan int)
+	low := make(chan int, 1)
+	low <- 1
+	close(low)
+	go func() {
+		high <- 2
+		close(high)
+	}()
+
+	s := NewPrioritySelect(PriorityOptions{}, high, low)
+	var got []int
+	for {
+		v, _, ok := s.Recv(done)
+		if !ok {
+			break
+		}
+		got = append(got, v)
+	}
+	if len(got) != 2 {
+		t.Fatalf("received %v, want both values", got)
+	}
+
+	close(done)
+	if _, index, ok := s.Recv(done); ok || index != -1 {
+		t.Fatal("Recv after done succeeded")
+	}
+}
+
+func TestPrioritySelectNilInterface(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	errs := make(chan error, 1)
+	errs <- nil
+	s := NewPrioritySelect(PriorityOptions{}, errs)
+	if err, index, ok := s.Recv(done); !ok || index != 0 || err != nil {
+		t.Fatalf("Recv returned %v, %d, %v; want nil, 0, true", err, index, ok)
+	}
+}
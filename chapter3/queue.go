@@ -0,0 +1,153 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Blocking queue
+//
+// TestCond keeps a queue of at most two items with one sync.Cond: the producer waits
+// while the queue is full and the consumers signal when they took an item. BlockingQueue
+// is that queue for any capacity and any number of producers and consumers. It uses two
+// conditions on one mutex, notFull for producers and notEmpty for consumers, so a Put
+// only wakes consumers and a Take only wakes producers.
+//
+// A sync.Cond cannot wait with a deadline. The timeout and context variants register a
+// function that broadcasts on the condition when the context is done, so the waiter wakes
+// up, sees the context is done and gives up.
+
+// ErrQueueClosed is returned by Put on a closed queue, and by Take on a closed queue that
+// has no items left.
+var ErrQueueClosed = errors.New("chapter3: queue closed")
+
+// BlockingQueue is a bounded FIFO queue safe for concurrent use.
+type BlockingQueue[T any] struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	// items is a ring buffer, head is the oldest item
+	items  []T
+	head   int
+	n      int
+	closed bool
+}
+
+// NewBlockingQueue returns an empty queue holding at most capacity items. A capacity
+// below 1 is taken as 1.
+func NewBlockingQueue[T any](capacity int) *BlockingQueue[T] {
+	q := &BlockingQueue[T]{items: make([]T, max(capacity, 1))}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// Put adds v to the queue, waiting while the queue is full.
+func (q *BlockingQueue[T]) Put(v T) error {
+	return q.PutCtx(context.Background(), v)
+}
+
+// PutTimeout is Put giving up with ErrTimeout after d.
+func (q *BlockingQueue[T]) PutTimeout(v T, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.PutCtx(ctx, v)
+}
+
+// PutCtx is Put giving up when ctx is done, with the errors of RecvCtx.
+func (q *BlockingQueue[T]) PutCtx(ctx context.Context, v T) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.wait(ctx, q.notFull, func() bool { return q.n < len(q.items) }); err != nil {
+		return err
+	}
+	q.items[(q.head+q.n)%len(q.items)] = v
+	q.n++
+	q.notEmpty.Signal()
+	return nil
+}
+
+// Take removes the oldest item from the queue, waiting while the queue is empty. The items
+// still queued when the queue is closed can be taken.
+func (q *BlockingQueue[T]) Take() (T, error) {
+	return q.TakeCtx(context.Background())
+}
+
+// TakeTimeout is Take giving up with ErrTimeout after d.
+func (q *BlockingQueue[T]) TakeTimeout(d time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.TakeCtx(ctx)
+}
+
+// TakeCtx is Take giving up when ctx is done, with the errors of RecvCtx.
+func (q *BlockingQueue[T]) TakeCtx(ctx context.Context) (T, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var zero T
+	if err := q.wait(ctx, q.notEmpty, func() bool { return q.n > 0 }); err != nil {
+		return zero, err
+	}
+	v := q.items[q.head]
+	q.items[q.head] = zero
+	q.head = (q.head + 1) % len(q.items)
+	q.n--
+	q.notFull.Signal()
+	return v, nil
+}
+
+// wait waits on c until ready returns true, the queue is closed or ctx is done. It is
+// called with q.mu held.
+func (q *BlockingQueue[T]) wait(ctx context.Context, c *sync.Cond, ready func() bool) error {
+	if ctx.Done() != nil {
+		stop := context.AfterFunc(ctx, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			c.Broadcast()
+		})
+		defer stop()
+	}
+
+	for !ready() {
+		// Take still drains the items of a closed queue, Put fails right away
+		if q.closed {
+			return ErrQueueClosed
+		}
+		if ctx.Err() != nil {
+			return ctxErr(ctx)
+		}
+		c.Wait()
+	}
+	if q.closed && c == q.notFull {
+		return ErrQueueClosed
+	}
+	return nil
+}
+
+// Close closes the queue and wakes every waiting Put and Take. Closing a closed queue
+// does nothing.
+func (q *BlockingQueue[T]) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// Len returns the number of queued items.
+func (q *BlockingQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// Cap returns the capacity of the queue.
+func (q *BlockingQueue[T]) Cap() int {
+	return len(q.items)
+}
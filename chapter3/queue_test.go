@@ -0,0 +1,115 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockingQueue(t *testing.T) {
+	const producers, consumers, perProducer = 8, 8, 1000
+
+	q := NewBlockingQueue[int](2)
+	var produced sync.WaitGroup
+	produced.Add(producers)
+	for p := 0; p < producers; p++ {
+		go func(p int) {
+			defer produced.Done()
+			for i := 0; i < perProducer; i++ {
+				if err := q.Put(p*perProducer + i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(p)
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var consumed sync.WaitGroup
+	consumed.Add(consumers)
+	for c := 0; c < consumers; c++ {
+		go func() {
+			defer consumed.Done()
+			for {
+				v, err := q.Take()
+				if err == ErrQueueClosed {
+					return
+				}
+				if q.Len() > q.Cap() {
+					t.Errorf("queue holds %d items, cap %d", q.Len(), q.Cap())
+				}
+				mu.Lock()
+				if seen[v] {
+					t.Errorf("%d taken twice", v)
+				}
+				seen[v] = true
+				mu.Unlock()
+			}
+		}()
+	}
+
+	produced.Wait()
+	q.Close()
+	consumed.Wait()
+
+	if len(seen) != producers*perProducer {
+		t.Fatalf("took %d items, want %d", len(seen), producers*perProducer)
+	}
+}
+
+func TestBlockingQueueOrder(t *testing.T) {
+	q := NewBlockingQueue[int](3)
+	for i := 1; i <= 3; i++ {
+		q.Put(i)
+	}
+	q.Close()
+	if err := q.Put(4); err != ErrQueueClosed {
+		t.Fatalf("Put on a closed queue: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if v, err := q.Take(); v != i || err != nil {
+			t.Fatalf("Take = %d, %v; want %d", v, err, i)
+		}
+	}
+	if _, err := q.Take(); err != ErrQueueClosed {
+		t.Fatalf("Take on a closed, empty queue: %v", err)
+	}
+}
+
+func TestBlockingQueueTimeout(t *testing.T) {
+	q := NewBlockingQueue[int](1)
+	if _, err := q.TakeTimeout(10 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("TakeTimeout on an empty queue: %v", err)
+	}
+	q.Put(1)
+	if err := q.PutTimeout(2, 10*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("PutTimeout on a full queue: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := q.PutCtx(ctx, 2); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("PutCtx after cancel: %v", err)
+	}
+}
+
+func TestBlockingQueueCloseWakesWaiters(t *testing.T) {
+	empty, full := NewBlockingQueue[int](1), NewBlockingQueue[int](1)
+	full.Put(1)
+
+	errs := make(chan error, 2)
+	go func() { _, err := empty.Take(); errs <- err }()
+	go func() { errs <- full.Put(2) }()
+
+	time.Sleep(10 * time.Millisecond)
+	empty.Close()
+	full.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrQueueClosed {
+			t.Fatalf("waiter woke up with %v", err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resource pool
+//
+// sync.Pool is a cache: the garbage collector may empty it at any time, and it creates as
+// many objects as there are concurrent Gets. That makes it a poor fit for the service
+// connections warmServiceConnCache keeps, which are expensive to make and should be
+// limited in number. ResourcePool is bounded instead:
+//
+//   - at most Max resources are borrowed at once, further Gets wait or give up with their
+//     context
+//   - Min resources are created up front and kept around, idle or borrowed
+//   - idle resources are closed after IdleTimeout, every resource after MaxLifetime
+//   - resources can be validated when they are borrowed and when they are returned
+
+// ErrPoolClosed is returned by Get on a closed pool.
+var ErrPoolClosed = errors.New("chapter3: pool closed")
+
+// PoolOptions configures a ResourcePool.
+type PoolOptions[T any] struct {
+	// New creates a resource.
+	New func(ctx context.Context) (T, error)
+
+	// Close, when set, releases a resource the pool got rid of.
+	Close func(T)
+
+	// ValidateBorrow and ValidateReturn, when set, are called before a resource is handed
+	// out and when it is given back. A resource failing either is closed.
+	ValidateBorrow func(T) bool
+	ValidateReturn func(T) bool
+
+	// Min is the number of resources the pool creates up front and keeps. Max is the
+	// number of resources that can be borrowed at once, no limit if zero.
+	Min, Max int
+
+	// IdleTimeout closes resources idle for longer, as long as Min are left. MaxLifetime
+	// closes resources older than that when they are next idle. Zero disables either.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+// PoolStats are the counters of a ResourcePool.
+type PoolStats struct {
+	Idle, InUse       int
+	Created, Closed   int64
+	Waits             int64
+	WaitTime          time.Duration
+	FailedValidations int64
+}
+
+// ResourcePool is a bounded pool of resources. It is safe for concurrent use.
+type ResourcePool[T any] struct {
+	opts PoolOptions[T]
+
+	// slots holds a token for every borrowed resource, so a full channel means exhausted
+	slots   chan struct{}
+	closing chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Resource[T] // the most recently returned last
+	size   int            // idle, borrowed, being created and being closed
+	closed bool
+	stats  PoolStats
+	// filling is closed when the running fill created its resources, nil without one
+	filling chan struct{}
+}
+
+// Resource is a borrowed resource. It must be given back with Release or Discard; once it
+// is given back, further calls of either do nothing, so a deferred Release can follow an
+// early Discard.
+type Resource[T any] struct {
+	Value T
+
+	pool      *ResourcePool[T]
+	created   time.Time
+	idleSince time.Time
+	returned  atomic.Bool
+}
+
+// NewResourcePool creates the pool and its Min resources.
+func NewResourcePool[T any](opts PoolOptions[T]) (*ResourcePool[T], error) {
+	if opts.New == nil {
+		return nil, errors.New("chapter3: pool without New")
+	}
+	if opts.Min < 0 || opts.Max < 0 || (opts.Max > 0 && opts.Min > opts.Max) {
+		return nil, errors.New("chapter3: pool needs 0 <= Min <= Max")
+	}
+
+	p := &ResourcePool[T]{
+		opts:    opts,
+		closing: make(chan struct{}),
+	}
+	if opts.Max > 0 {
+		p.slots = make(chan struct{}, opts.Max)
+	}
+
+	if err := p.fill(context.Background()); err != nil {
+		p.Close()
+		return nil, err
+	}
+	go p.maintain()
+	return p, nil
+}
+
+// fill creates resources, concurrently, until there are Min.
+func (p *ResourcePool[T]) fill(ctx context.Context) error {
+	p.mu.Lock()
+	missing := p.opts.Min - p.size
+	if missing <= 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	p.size += missing
+	filling := make(chan struct{})
+	p.filling = filling
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		if p.filling == filling {
+			p.filling = nil
+		}
+		p.mu.Unlock()
+		close(filling)
+	}()
+
+	errs := make(chan error, missing)
+	for i := 0; i < missing; i++ {
+		go func() {
+			v, err := p.opts.New(ctx)
+			if err != nil {
+				p.mu.Lock()
+				p.size--
+				p.mu.Unlock()
+				errs <- err
+				return
+			}
+			now := time.Now()
+			r := &Resource[T]{Value: v, pool: p, created: now, idleSince: now}
+			p.mu.Lock()
+			p.stats.Created++
+			if p.closed {
+				p.mu.Unlock()
+				p.destroy(r)
+				errs <- nil
+				return
+			}
+			p.idle = append(p.idle, r)
+			p.mu.Unlock()
+			errs <- nil
+		}()
+	}
+
+	var err error
+	for i := 0; i < missing; i++ {
+		err = errors.Join(err, <-errs)
+	}
+	return err
+}
+
+// maintain closes expired idle resources and refills the pool to Min, until Close.
+func (p *ResourcePool[T]) maintain() {
+	if p.opts.IdleTimeout <= 0 && p.opts.MaxLifetime <= 0 {
+		return
+	}
+	t := time.NewTicker(min(nonZero(p.opts.IdleTimeout), nonZero(p.opts.MaxLifetime)) / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		var expired []*Resource[T]
+		p.mu.Lock()
+		kept := p.idle[:0]
+		for _, r := range p.idle {
+			idleTooLong := p.opts.IdleTimeout > 0 && now.Sub(r.idleSince) > p.opts.IdleTimeout &&
+				p.size-len(expired) > p.opts.Min
+			if idleTooLong || p.tooOld(r, now) {
+				expired = append(expired, r)
+				continue
+			}
+			kept = append(kept, r)
+		}
+		clear(p.idle[len(kept):])
+		p.idle = kept
+		p.mu.Unlock()
+
+		for _, r := range expired {
+			p.destroy(r)
+		}
+		if err := p.fill(context.Background()); err != nil {
+			log.Printf("cannot refill pool: %v", err)
+		}
+	}
+}
+
+// nonZero maps zero to the largest duration, so min ignores disabled timeouts.
+func nonZero(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 1<<63 - 1
+	}
+	return d
+}
+
+func (p *ResourcePool[T]) tooOld(r *Resource[T], now time.Time) bool {
+	return p.opts.MaxLifetime > 0 && now.Sub(r.created) > p.opts.MaxLifetime
+}
+
+// Get borrows a resource, creating one if none is idle. When Max resources are borrowed it
+// waits for one to be returned, until ctx is done.
+func (p *ResourcePool[T]) Get(ctx context.Context) (*Resource[T], error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.releaseSlot()
+			return nil, ErrPoolClosed
+		}
+		n := len(p.idle)
+		if n == 0 && p.filling != nil && p.opts.Max > 0 && p.size >= p.opts.Max {
+			// the resources a refill is creating would be ours, one more would exceed Max
+			filling := p.filling
+			p.mu.Unlock()
+			select {
+			case <-filling:
+				continue
+			case <-p.closing:
+				p.releaseSlot()
+				return nil, ErrPoolClosed
+			case <-ctx.Done():
+				p.releaseSlot()
+				return nil, ctxErr(ctx)
+			}
+		}
+		if n == 0 {
+			p.size++
+			p.mu.Unlock()
+			break
+		}
+		r := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if p.tooOld(r, time.Now()) {
+			p.destroy(r)
+			continue
+		}
+		if p.opts.ValidateBorrow != nil && !p.opts.ValidateBorrow(r.Value) {
+			p.failedValidation()
+			p.destroy(r)
+			continue
+		}
+		// a fresh handle for every borrower, so a stale one given back twice is noticed
+		return &Resource[T]{Value: r.Value, pool: p, created: r.created}, nil
+	}
+
+	v, err := p.opts.New(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.size--
+		p.mu.Unlock()
+		p.releaseSlot()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.stats.Created++
+	p.mu.Unlock()
+	return &Resource[T]{Value: v, pool: p, created: time.Now()}, nil
+}
+
+func (p *ResourcePool[T]) acquire(ctx context.Context) error {
+	if p.slots == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	defer func() {
+		p.mu.Lock()
+		p.stats.Waits++
+		p.stats.WaitTime += time.Since(start)
+		p.mu.Unlock()
+	}()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-p.closing:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	}
+}
+
+func (p *ResourcePool[T]) releaseSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// Release gives the resource back to the pool.
+func (r *Resource[T]) Release() {
+	if r.returned.Swap(true) {
+		return
+	}
+	p := r.pool
+	defer p.releaseSlot()
+
+	if p.opts.ValidateReturn != nil && !p.opts.ValidateReturn(r.Value) {
+		p.failedValidation()
+		p.destroy(r)
+		return
+	}
+
+	r.idleSince = time.Now()
+	p.mu.Lock()
+	if p.closed || p.tooOld(r, r.idleSince) {
+		p.mu.Unlock()
+		p.destroy(r)
+		return
+	}
+	p.idle = append(p.idle, r)
+	p.mu.Unlock()
+}
+
+// Discard closes a resource that turned out to be broken instead of giving it back.
+func (r *Resource[T]) Discard() {
+	if r.returned.Swap(true) {
+		return
+	}
+	defer r.pool.releaseSlot()
+	r.pool.destroy(r)
+}
+
+// destroy closes a resource that is counted in size. It only leaves size once it is
+// closed, so a new one is not created while the old one is still alive.
+func (p *ResourcePool[T]) destroy(r *Resource[T]) {
+	p.closeResource(r)
+	p.mu.Lock()
+	p.size--
+	p.mu.Unlock()
+}
+
+func (p *ResourcePool[T]) closeResource(r *Resource[T]) {
+	p.mu.Lock()
+	p.stats.Closed++
+	p.mu.Unlock()
+	if p.opts.Close != nil {
+		p.opts.Close(r.Value)
+	}
+}
+
+func (p *ResourcePool[T]) failedValidation() {
+	p.mu.Lock()
+	p.stats.FailedValidations++
+	p.mu.Unlock()
+}
+
+// Stats returns the current counters.
+func (p *ResourcePool[T]) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats
+	s.Idle = len(p.idle)
+	s.InUse = p.size - len(p.idle)
+	return s
+}
+
+// Close closes the idle resources and makes waiting and later Gets fail. Borrowed
+// resources are closed when they are given back.
+func (p *ResourcePool[T]) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.size -= len(idle)
+	p.mu.Unlock()
+
+	close(p.closing)
+	for _, r := range idle {
+		p.closeResource(r)
+	}
+}
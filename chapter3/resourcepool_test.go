@@ -0,0 +1,235 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	id     int64
+	broken atomic.Bool
+	closed atomic.Bool
+}
+
+func fakeConnPool(t *testing.T, opts PoolOptions[*fakeConn]) (*ResourcePool[*fakeConn], *atomic.Int64) {
+	t.Helper()
+	var dialed atomic.Int64
+	opts.New = func(ctx context.Context) (*fakeConn, error) {
+		return &fakeConn{id: dialed.Add(1)}, nil
+	}
+	opts.Close = func(c *fakeConn) { c.closed.Store(true) }
+	p, err := NewResourcePool(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p, &dialed
+}
+
+func TestResourcePoolBounded(t *testing.T) {
+	p, dialed := fakeConnPool(t, PoolOptions[*fakeConn]{Min: 2, Max: 4})
+	if dialed.Load() != 2 || p.Stats().Idle != 2 {
+		t.Fatalf("warm-up dialed %d connections, %d idle", dialed.Load(), p.Stats().Idle)
+	}
+
+	// many borrowers, never more than Max at once
+	var inUse, most atomic.Int64
+	var borrowers sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		borrowers.Add(1)
+		go func() {
+			defer borrowers.Done()
+			r, err := p.Get(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := inUse.Add(1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			inUse.Add(-1)
+			r.Release()
+		}()
+	}
+	borrowers.Wait()
+
+	if most.Load() > 4 || dialed.Load() > 4 {
+		t.Fatalf("%d borrowed at once, %d dialed; max is 4", most.Load(), dialed.Load())
+	}
+	if s := p.Stats(); s.Waits == 0 || s.InUse != 0 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestResourcePoolExhausted(t *testing.T) {
+	p, _ := fakeConnPool(t, PoolOptions[*fakeConn]{Max: 1})
+	r, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Get from an exhausted pool: %v", err)
+	}
+
+	// a returned resource goes to the next borrower
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Release()
+	}()
+	again, err := p.Get(context.Background())
+	if err != nil || again.Value != r.Value {
+		t.Fatalf("Get = %v, %v; want the released connection", again, err)
+	}
+	again.Release()
+
+	p.Close()
+	if _, err := p.Get(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("Get from a closed pool: %v", err)
+	}
+	if !r.Value.closed.Load() {
+		t.Fatal("Close left an idle connection open")
+	}
+}
+
+func TestResourcePoolReturnTwice(t *testing.T) {
+	p, _ := fakeConnPool(t, PoolOptions[*fakeConn]{Max: 1})
+	r, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Release()
+	again, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale handle must neither free the slot of the new borrower nor queue the
+	// connection a second time
+	r.Release()
+	r.Discard()
+	if s := p.Stats(); s.InUse != 1 || s.Idle != 0 || again.Value.closed.Load() {
+		t.Fatalf("stale handle changed the pool: %+v", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Get past Max: %v", err)
+	}
+
+	again.Discard()
+	again.Release()
+	if s := p.Stats(); s.InUse != 0 || s.Idle != 0 || s.Closed != 1 {
+		t.Fatalf("after Discard and Release: %+v", s)
+	}
+}
+
+func TestResourcePoolValidate(t *testing.T) {
+	p, dialed := fakeConnPool(t, PoolOptions[*fakeConn]{
+		Max:            2,
+		ValidateBorrow: func(c *fakeConn) bool { return !c.broken.Load() },
+		ValidateReturn: func(c *fakeConn) bool { return c.id != 2 },
+	})
+
+	r, _ := p.Get(context.Background())
+	r.Value.broken.Store(true)
+	r.Release()
+
+	// connection 1 broke while idle, so it is replaced by 2
+	r, _ = p.Get(context.Background())
+	if r.Value.id != 2 {
+		t.Fatalf("borrowed connection %d, want 2", r.Value.id)
+	}
+	r.Release()
+	if s := p.Stats(); s.FailedValidations != 2 || s.Closed != 2 || s.Idle != 0 || dialed.Load() != 2 {
+		t.Fatalf("stats %+v after two failed validations", s)
+	}
+
+	r, _ = p.Get(context.Background())
+	r.Discard()
+	if !r.Value.closed.Load() || p.Stats().Closed != 3 {
+		t.Fatal("Discard did not close the connection")
+	}
+}
+
+func TestResourcePoolExpiry(t *testing.T) {
+	p, dialed := fakeConnPool(t, PoolOptions[*fakeConn]{
+		Min:         1,
+		IdleTimeout: 10 * time.Millisecond,
+		MaxLifetime: 50 * time.Millisecond,
+	})
+
+	// a second idle connection is closed after the idle timeout, the first one is kept
+	r1, _ := p.Get(context.Background())
+	r2, _ := p.Get(context.Background())
+	r1.Release()
+	r2.Release()
+	time.Sleep(30 * time.Millisecond)
+	if s := p.Stats(); s.Idle != 1 || s.Closed != 1 {
+		t.Fatalf("stats %+v after the idle timeout", s)
+	}
+
+	// every connection is replaced after its lifetime, keeping Min
+	time.Sleep(60 * time.Millisecond)
+	if s := p.Stats(); s.Idle != 1 || dialed.Load() < 3 {
+		t.Fatalf("stats %+v, %d dialed after the lifetime", s, dialed.Load())
+	}
+}
+
+func TestResourcePoolRefillWithinMax(t *testing.T) {
+	const max = 3
+	var live, most atomic.Int64
+	p, err := NewResourcePool(PoolOptions[int]{
+		New: func(ctx context.Context) (int, error) {
+			n := live.Add(1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+			time.Sleep(2 * time.Millisecond)
+			return 0, nil
+		},
+		Close:       func(int) { live.Add(-1) },
+		Min:         max,
+		Max:         max,
+		IdleTimeout: 5 * time.Millisecond,
+		MaxLifetime: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// resources expire and get discarded all the time, so maintain keeps refilling
+	// while the borrowers create their own
+	var borrowers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		borrowers.Add(1)
+		go func(i int) {
+			defer borrowers.Done()
+			for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); {
+				r, err := p.Get(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+				if i%2 == 0 {
+					r.Discard()
+				} else {
+					r.Release()
+				}
+			}
+		}(i)
+	}
+	borrowers.Wait()
+
+	if most.Load() > max {
+		t.Fatalf("%d resources alive at once, Max is %d", most.Load(), max)
+	}
+}
@@ -0,0 +1,221 @@
+package chapter3
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"reflect"
+	"sync"
+)
+
+// Sharding
+//
+// TestMutext guards its counter with one mutex, which is fine for one counter but makes a
+// shared map a hot spot: every goroutine waits for the same lock, whatever key it wants.
+// ShardedMap splits the map into shards, each with its own lock, and picks the shard by
+// the hash of the key, so goroutines working on different keys rarely meet. StripedLock
+// does the same for data that is not a map: it hands out one of a fixed set of mutexes by
+// key.
+
+// cacheLine pads the shards, so the locks of neighbouring shards do not share a cache
+// line and slow each other down.
+const cacheLine = 64
+
+// HashFunc hashes a key. It must return the same value for equal keys.
+type HashFunc[K comparable] func(K) uint64
+
+var hashSeed = maphash.MakeSeed()
+
+// DefaultHash returns the hash of keys whose underlying type is a string or an integer,
+// and nil for any other key type. Those need a HashFunc of their own: hashing a printed
+// form, say, would put 0.0 and -0.0 in different shards although a map treats them as
+// one key.
+func DefaultHash[K comparable]() HashFunc[K] {
+	switch reflect.TypeFor[K]().Kind() {
+	case reflect.String:
+		return func(k K) uint64 { return maphash.String(hashSeed, reflect.ValueOf(k).String()) }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(k K) uint64 { return mix(uint64(reflect.ValueOf(k).Int())) }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(k K) uint64 { return mix(reflect.ValueOf(k).Uint()) }
+	}
+	return nil
+}
+
+// hashOrDefault returns hash, or DefaultHash when hash is nil. It panics when K has no
+// default hash, since sharding by a wrong hash would lose keys silently.
+func hashOrDefault[K comparable](hash HashFunc[K]) HashFunc[K] {
+	if hash == nil {
+		hash = DefaultHash[K]()
+	}
+	if hash == nil {
+		var zero K
+		panic(fmt.Sprintf("chapter3: no default hash for key type %T, pass a HashFunc", zero))
+	}
+	return hash
+}
+
+// mix spreads the bits of an integer key, so consecutive keys land in different shards
+// (the finalizer of splitmix64).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// shardCount returns the shard count rounded up to a power of two, at least 1, and the
+// mask selecting a shard from a hash.
+func shardCount(n int) (int, uint64) {
+	count := 1 << bits.Len(uint(max(n, 1)-1))
+	return count, uint64(count - 1)
+}
+
+type shard[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]V
+	_  [cacheLine - 32]byte
+}
+
+// ShardedMap is a map safe for concurrent use, split into independently locked shards.
+type ShardedMap[K comparable, V any] struct {
+	shards []shard[K, V]
+	mask   uint64
+	hash   HashFunc[K]
+}
+
+// NewShardedMap returns an empty map with shards rounded up to a power of two. A nil hash
+// means DefaultHash, and panics for key types it does not cover.
+func NewShardedMap[K comparable, V any](shards int, hash HashFunc[K]) *ShardedMap[K, V] {
+	hash = hashOrDefault(hash)
+	count, mask := shardCount(shards)
+	m := &ShardedMap[K, V]{shards: make([]shard[K, V], count), mask: mask, hash: hash}
+	for i := range m.shards {
+		m.shards[i].m = make(map[K]V)
+	}
+	return m
+}
+
+func (m *ShardedMap[K, V]) shard(k K) *shard[K, V] {
+	return &m.shards[m.hash(k)&m.mask]
+}
+
+// Load returns the value stored for k.
+func (m *ShardedMap[K, V]) Load(k K) (v V, ok bool) {
+	s := m.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok = s.m[k]
+	return v, ok
+}
+
+// Store sets the value for k.
+func (m *ShardedMap[K, V]) Store(k K, v V) {
+	s := m.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[k] = v
+}
+
+// LoadOrStore returns the value stored for k if there is one, and otherwise stores v.
+// loaded reports whether the value was already there.
+func (m *ShardedMap[K, V]) LoadOrStore(k K, v V) (actual V, loaded bool) {
+	s := m.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if actual, loaded = s.m[k]; loaded {
+		return actual, true
+	}
+	s.m[k] = v
+	return v, false
+}
+
+// Update replaces the value for k by what fn returns for the current one, atomically.
+// When fn returns keep false, k is deleted.
+func (m *ShardedMap[K, V]) Update(k K, fn func(v V, ok bool) (updated V, keep bool)) {
+	s := m.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.m[k]
+	if v, keep := fn(v, ok); keep {
+		s.m[k] = v
+	} else {
+		delete(s.m, k)
+	}
+}
+
+// Delete removes k.
+func (m *ShardedMap[K, V]) Delete(k K) {
+	s := m.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, k)
+}
+
+// Len returns the number of keys. The shards are counted one by one, so under concurrent
+// writes the result is only an estimate.
+func (m *ShardedMap[K, V]) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		n += len(s.m)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Range calls fn for every key and value until fn returns false. A shard is read locked
+// while fn runs on its keys, so fn must not write to the map.
+func (m *ShardedMap[K, V]) Range(fn func(k K, v V) bool) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		for k, v := range s.m {
+			if !fn(k, v) {
+				s.mu.RUnlock()
+				return
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+type stripe struct {
+	sync.Mutex
+	_ [cacheLine - 8]byte
+}
+
+// StripedLock is a fixed set of mutexes picked by key: equal keys always get the same
+// mutex, different keys usually different ones.
+type StripedLock[K comparable] struct {
+	stripes []stripe
+	mask    uint64
+	hash    HashFunc[K]
+}
+
+// NewStripedLock returns a lock with stripes rounded up to a power of two. A nil hash
+// means DefaultHash, and panics for key types it does not cover.
+func NewStripedLock[K comparable](stripes int, hash HashFunc[K]) *StripedLock[K] {
+	hash = hashOrDefault(hash)
+	count, mask := shardCount(stripes)
+	return &StripedLock[K]{stripes: make([]stripe, count), mask: mask, hash: hash}
+}
+
+// Locker returns the mutex of k.
+func (l *StripedLock[K]) Locker(k K) sync.Locker {
+	return &l.stripes[l.hash(k)&l.mask].Mutex
+}
+
+// Lock locks the mutex of k.
+func (l *StripedLock[K]) Lock(k K) {
+	l.Locker(k).Lock()
+}
+
+// Unlock unlocks the mutex of k.
+func (l *StripedLock[K]) Unlock(k K) {
+	l.Locker(k).Unlock()
+}
@@ -0,0 +1,286 @@
+package chapter3
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestShardedMap(t *testing.T) {
+	m := NewShardedMap[string, int](6, nil)
+	if len(m.shards) != 8 {
+		t.Fatalf("%d shards, want 8", len(m.shards))
+	}
+
+	m.Store("a", 1)
+	if v, loaded := m.LoadOrStore("a", 2); v != 1 || !loaded {
+		t.Fatalf("LoadOrStore = %d, %v", v, loaded)
+	}
+	if v, loaded := m.LoadOrStore("b", 2); v != 2 || loaded {
+		t.Fatalf("LoadOrStore = %d, %v", v, loaded)
+	}
+	m.Update("a", func(v int, ok bool) (int, bool) { return v + 10, true })
+	m.Update("b", func(v int, ok bool) (int, bool) { return 0, false })
+	if v, ok := m.Load("a"); v != 11 || !ok {
+		t.Fatalf("Load(a) = %d, %v", v, ok)
+	}
+	if _, ok := m.Load("b"); ok || m.Len() != 1 {
+		t.Fatal("Update did not delete b")
+	}
+	m.Delete("a")
+	if m.Len() != 0 {
+		t.Fatal("Delete did not delete a")
+	}
+}
+
+func TestShardedMapConcurrent(t *testing.T) {
+	// TestMutext's counter, one per key
+	counts := NewShardedMap[int, int](16, nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				counts.Update(i%100, func(v int, _ bool) (int, bool) { return v + 1, true })
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	counts.Range(func(k, v int) bool {
+		if v != 160 {
+			t.Errorf("key %d counted %d times, want 160", k, v)
+		}
+		total += v
+		return true
+	})
+	if total != 16000 || counts.Len() != 100 {
+		t.Fatalf("total %d over %d keys", total, counts.Len())
+	}
+}
+
+func TestShardedMapHash(t *testing.T) {
+	// a hash putting everything in shard 0 still works, just without spreading
+	m := NewShardedMap[string, int](4, func(string) uint64 { return 0 })
+	for i := 0; i < 10; i++ {
+		m.Store(strconv.Itoa(i), i)
+	}
+	if len(m.shards[0].m) != 10 {
+		t.Fatalf("shard 0 holds %d keys, want all 10", len(m.shards[0].m))
+	}
+}
+
+func TestShardedMapKeyTypes(t *testing.T) {
+	for name, newMap := range map[string]func(){
+		"float64":     func() { NewShardedMap[float64, int](4, nil) },
+		"interface{}": func() { NewShardedMap[interface{}, int](4, nil) },
+		"struct":      func() { NewStripedLock[struct{ a, b int }](4, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s keys without a HashFunc did not panic", name)
+				}
+			}()
+			newMap()
+		}()
+	}
+
+	// named types hash like their underlying type
+	type userID string
+	type port uint16
+	users := NewShardedMap[userID, int](4, nil)
+	users.Store("alice", 1)
+	if v, ok := users.Load("alice"); !ok || v != 1 {
+		t.Fatalf("Load(userID) = %d, %v", v, ok)
+	}
+	if DefaultHash[userID]()("alice") != DefaultHash[string]()("alice") {
+		t.Error("userID and string hash differently")
+	}
+	if DefaultHash[port]()(80) != DefaultHash[uint64]()(80) {
+		t.Error("port and uint64 hash differently")
+	}
+
+	// with a hash that agrees with ==, 0.0 and -0.0 are one key, as in a Go map
+	m := NewShardedMap[float64, int](4, func(f float64) uint64 {
+		return math.Float64bits(f + 0) // -0.0 + 0 is 0.0
+	})
+	m.Store(0.0, 1)
+	if v, ok := m.Load(math.Copysign(0, -1)); !ok || v != 1 {
+		t.Fatalf("Load(-0.0) = %d, %v; want the value of 0.0", v, ok)
+	}
+}
+
+func TestStripedLock(t *testing.T) {
+	locks := NewStripedLock[string](8, nil)
+	if locks.Locker("a") != locks.Locker("a") {
+		t.Fatal("same key, different locks")
+	}
+
+	// each balance is only guarded by the stripe of its owner
+	owners := []string{"alice", "bob"}
+	var balances [2]int
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				locks.Lock(owners[g%2])
+				balances[g%2]++
+				locks.Unlock(owners[g%2])
+			}
+		}(g)
+	}
+	wg.Wait()
+	if balances != [2]int{4000, 4000} {
+		t.Fatalf("balances %v, want 4000 each", balances)
+	}
+}
+
+// The benchmarks read 90% of the time over 1024 keys from all GOMAXPROCS goroutines.
+const benchKeys = 1024
+
+type benchMap interface {
+	load(int) (int, bool)
+	store(int, int)
+}
+
+type mutexMap struct {
+	mu sync.Mutex
+	m  map[int]int
+}
+
+func (m *mutexMap) load(k int) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.m[k]
+	return v, ok
+}
+
+func (m *mutexMap) store(k, v int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.m[k] = v
+}
+
+type rwMutexMap struct {
+	mu sync.RWMutex
+	m  map[int]int
+}
+
+func (m *rwMutexMap) load(k int) (int, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.m[k]
+	return v, ok
+}
+
+func (m *rwMutexMap) store(k, v int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.m[k] = v
+}
+
+type syncMap struct{ m sync.Map }
+
+func (m *syncMap) load(k int) (int, bool) {
+	v, ok := m.m.Load(k)
+	if !ok {
+		return 0, false
+	}
+	return v.(int), true
+}
+
+func (m *syncMap) store(k, v int) { m.m.Store(k, v) }
+
+type shardedMap struct{ m *ShardedMap[int, int] }
+
+func (m shardedMap) load(k int) (int, bool) { return m.m.Load(k) }
+func (m shardedMap) store(k, v int)         { m.m.Store(k, v) }
+
+func benchmarkMap(b *testing.B, m benchMap) {
+	for k := 0; k < benchKeys; k++ {
+		m.store(k, k)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := (i * 7919) % benchKeys
+			if i%10 == 0 {
+				m.store(k, i)
+			} else {
+				m.load(k)
+			}
+		}
+	})
+}
+
+func BenchmarkMapMutex(b *testing.B) {
+	benchmarkMap(b, &mutexMap{m: make(map[int]int)})
+}
+
+func BenchmarkMapRWMutex(b *testing.B) {
+	benchmarkMap(b, &rwMutexMap{m: make(map[int]int)})
+}
+
+func BenchmarkMapSyncMap(b *testing.B) {
+	benchmarkMap(b, &syncMap{})
+}
+
+func BenchmarkMapSharded(b *testing.B) {
+	benchmarkMap(b, shardedMap{NewShardedMap[int, int](64, nil)})
+}
+
+// The lock benchmarks guard one counter per key, with the same 90% reads as the map
+// benchmarks. The single locks guard all counters, the striped lock one stripe of them.
+func benchmarkLock(b *testing.B, lock, unlock func(k int, read bool)) {
+	counters := make([]int, benchKeys)
+	b.RunParallel(func(pb *testing.PB) {
+		sum := 0
+		for i := 0; pb.Next(); i++ {
+			k := (i * 7919) % benchKeys
+			read := i%10 != 0
+			lock(k, read)
+			if read {
+				sum += counters[k]
+			} else {
+				counters[k]++
+			}
+			unlock(k, read)
+		}
+		_ = sum
+	})
+}
+
+func BenchmarkLockMutex(b *testing.B) {
+	var mu sync.Mutex
+	benchmarkLock(b, func(int, bool) { mu.Lock() }, func(int, bool) { mu.Unlock() })
+}
+
+func BenchmarkLockRWMutex(b *testing.B) {
+	var mu sync.RWMutex
+	benchmarkLock(b,
+		func(_ int, read bool) {
+			if read {
+				mu.RLock()
+			} else {
+				mu.Lock()
+			}
+		},
+		func(_ int, read bool) {
+			if read {
+				mu.RUnlock()
+			} else {
+				mu.Unlock()
+			}
+		})
+}
+
+func BenchmarkLockStriped(b *testing.B) {
+	locks := NewStripedLock[int](64, nil)
+	benchmarkLock(b, func(k int, _ bool) { locks.Lock(k) }, func(k int, _ bool) { locks.Unlock(k) })
+}
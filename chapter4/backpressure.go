@@ -0,0 +1,471 @@
+package chapter4
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Backpressure
+//
+// An unbuffered channel couples the producer to its consumer: the producer only moves on
+// once the consumer took the value. A buffer absorbs short bursts, but when the consumer
+// is slower for long enough the buffer fills up and we are back to blocking. Blocking is
+// the right default (nothing is lost), but for some streams the newest value is worth
+// more than a complete history, and for others the history matters more than memory.
+//
+// An Edge is a channel with an overflow policy deciding what Send does when the buffer is
+// full:
+//
+//   - Block:      wait for the consumer, like a plain channel
+//   - DropNewest: throw the value being sent away
+//   - DropOldest: throw the oldest buffered value away to make room
+//   - Sample:     keep only every Nth value while the buffer is full
+//   - Spill:      write the value to a bounded file and feed it back later, in order
+
+// OverflowPolicy decides what an Edge does with a value sent while its buffer is full.
+type OverflowPolicy int
+
+const (
+	Block OverflowPolicy = iota
+	DropNewest
+	DropOldest
+	Sample
+	Spill
+)
+
+var overflowPolicyNames = []string{"block", "drop-newest", "drop-oldest", "sample", "spill"}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowPolicyNames) {
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+	return overflowPolicyNames[p]
+}
+
+// MarshalText encodes the policy by name, e.g. "drop-oldest".
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes a policy name.
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	for i, name := range overflowPolicyNames {
+		if name == string(text) {
+			*p = OverflowPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("chapter4: unknown overflow policy %q", text)
+}
+
+// Backpressure configures the overflow policy of an Edge. The zero value blocks.
+type Backpressure struct {
+	Policy OverflowPolicy `json:"policy"`
+
+	// Every is the sampling rate of Sample: while the buffer is full only every Nth
+	// value is kept, the others are dropped.
+	Every int `json:"every,omitempty"`
+
+	// SpillDir is the directory of the spill file of Spill, os.TempDir when empty.
+	SpillDir string `json:"spill_dir,omitempty"`
+
+	// SpillLimit is the maximum number of values Spill keeps on disk. Values sent while
+	// the file is full are dropped.
+	SpillLimit int `json:"spill_limit,omitempty"`
+}
+
+// validate checks bp for an edge buffering capacity values. The dropping policies only
+// act on a full buffer, and an unbuffered channel is full whenever its reader is not
+// parked on it, so they need a buffer of at least one value.
+func (bp Backpressure) validate(capacity int) error {
+	switch bp.Policy {
+	case DropNewest, DropOldest, Sample:
+		if capacity < 1 {
+			return fmt.Errorf("chapter4: %v policy needs a buffer >= 1, got %d", bp.Policy, capacity)
+		}
+		if bp.Policy == Sample && bp.Every < 1 {
+			return fmt.Errorf("chapter4: sample policy needs every >= 1, got %d", bp.Every)
+		}
+	case Spill:
+		if bp.SpillLimit < 1 {
+			return fmt.Errorf("chapter4: spill policy needs spill_limit >= 1, got %d", bp.SpillLimit)
+		}
+	}
+	return nil
+}
+
+// Edge is a channel between two stages with an overflow policy.
+type Edge[T any] struct {
+	ch chan T
+	bp Backpressure
+
+	sent     atomic.Int64
+	dropped  atomic.Int64
+	spilled  atomic.Int64
+	overflow atomic.Int64
+
+	spill     *spillBuffer[T]
+	closeOnce sync.Once
+}
+
+// NewEdge returns an edge buffering capacity values. Spilled values are stored as JSON.
+func NewEdge[T any](capacity int, bp Backpressure) (*Edge[T], error) {
+	return newEdge(capacity, bp, func(b []byte) (T, error) {
+		var v T
+		err := json.Unmarshal(b, &v)
+		return v, err
+	})
+}
+
+func newEdge[T any](capacity int, bp Backpressure, decode func([]byte) (T, error)) (*Edge[T], error) {
+	if err := bp.validate(capacity); err != nil {
+		return nil, err
+	}
+
+	e := &Edge[T]{ch: make(chan T, capacity), bp: bp}
+	if bp.Policy == Spill {
+		s, err := newSpillBuffer(e.ch, bp, decode)
+		if err != nil {
+			return nil, err
+		}
+		e.spill = s
+	}
+	return e, nil
+}
+
+// C returns the channel consumers read from. It is closed after Close once every
+// spilled value has been delivered.
+func (e *Edge[T]) C() <-chan T {
+	return e.ch
+}
+
+// Send passes v on according to the overflow policy. It returns false if done was
+// closed before v could be handled. Send must not be called after Close.
+func (e *Edge[T]) Send(done <-chan interface{}, v T) bool {
+	if e.spill != nil {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		return e.sendSpill(v)
+	}
+
+	select {
+	case e.ch <- v:
+		e.sent.Add(1)
+		return true
+	default:
+	}
+
+	switch e.bp.Policy {
+	case DropNewest:
+		e.dropped.Add(1)
+		return true
+
+	case DropOldest:
+		for {
+			select {
+			case <-done:
+				return false
+			case e.ch <- v:
+				e.sent.Add(1)
+				return true
+			default:
+			}
+			select {
+			case <-e.ch:
+				e.dropped.Add(1)
+			default:
+			}
+		}
+
+	case Sample:
+		if e.overflow.Add(1)%int64(e.bp.Every) != 0 {
+			e.dropped.Add(1)
+			return true
+		}
+	}
+
+	select {
+	case <-done:
+		return false
+	case e.ch <- v:
+		e.sent.Add(1)
+		return true
+	}
+}
+
+// sendSpill sends v directly while nothing is waiting on disk, and appends it to the
+// spill file otherwise, so values are delivered in the order they were sent.
+func (e *Edge[T]) sendSpill(v T) bool {
+	s := e.spill
+	s.mu.Lock()
+	if s.pending == 0 {
+		select {
+		case e.ch <- v:
+			s.mu.Unlock()
+			e.sent.Add(1)
+			return true
+		default:
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.push(v); err != nil {
+		e.dropped.Add(1)
+	} else {
+		e.spilled.Add(1)
+	}
+	return true
+}
+
+// Close closes the edge. With Spill the channel is closed once the spilled values have
+// been delivered.
+func (e *Edge[T]) Close() {
+	e.closeOnce.Do(func() {
+		if e.spill != nil {
+			e.spill.close()
+			return
+		}
+		close(e.ch)
+	})
+}
+
+// stop stops feeding spilled values back, it is called once the pipeline is cancelled.
+func (e *Edge[T]) stop() {
+	if e.spill != nil {
+		e.spill.stop()
+	}
+}
+
+// Sent returns the number of values put on the channel, without counting the values
+// delivered from the spill file.
+func (e *Edge[T]) Sent() int64 { return e.sent.Load() }
+
+// Dropped returns the number of values thrown away by the overflow policy.
+func (e *Edge[T]) Dropped() int64 { return e.dropped.Load() }
+
+// Spilled returns the number of values written to the spill file.
+func (e *Edge[T]) Spilled() int64 { return e.spilled.Load() }
+
+// Len returns the number of values waiting in the channel buffer and the spill file.
+func (e *Edge[T]) Len() int {
+	n := len(e.ch)
+	if e.spill != nil {
+		n += e.spill.len()
+	}
+	return n
+}
+
+// Cap returns the capacity of the channel buffer.
+func (e *Edge[T]) Cap() int { return cap(e.ch) }
+
+// Err returns the first error of the spill file, if any.
+func (e *Edge[T]) Err() error {
+	if e.spill == nil {
+		return nil
+	}
+	return e.spill.error()
+}
+
+// spillBuffer is a bounded FIFO of JSON lines in a temporary file. A pump goroutine feeds
+// the values back into the edge's channel in the order they were written.
+type spillBuffer[T any] struct {
+	ch     chan T
+	limit  int
+	decode func([]byte) (T, error)
+
+	mu      sync.Mutex
+	w       *os.File
+	rf      *os.File
+	r       *bufio.Reader
+	pending int // values written but not yet delivered
+	closed  bool
+	err     error
+
+	wake    chan struct{}
+	quit    chan struct{}
+	stopped sync.Once
+	closeCh sync.Once
+}
+
+func newSpillBuffer[T any](ch chan T, bp Backpressure, decode func([]byte) (T, error)) (*spillBuffer[T], error) {
+	w, err := os.CreateTemp(bp.SpillDir, "edge-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	rf, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+
+	s := &spillBuffer[T]{
+		ch:     ch,
+		limit:  bp.SpillLimit,
+		decode: decode,
+		w:      w,
+		rf:     rf,
+		r:      bufio.NewReader(rf),
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	go s.pump()
+	return s, nil
+}
+
+var errSpillFull = errors.New("chapter4: spill file is full")
+
+func (s *spillBuffer[T]) push(v T) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending >= s.limit {
+		return errSpillFull
+	}
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		s.setErr(err)
+		return err
+	}
+	s.pending++
+	s.notify()
+	return nil
+}
+
+func (s *spillBuffer[T]) pump() {
+	defer s.cleanup()
+
+	for {
+		s.mu.Lock()
+		if s.pending == 0 {
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case <-s.quit:
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+
+		line, err := s.r.ReadBytes('\n')
+		s.mu.Unlock()
+
+		var v T
+		if err == nil {
+			v, err = s.decode(line)
+		}
+		if err != nil {
+			s.fail(err)
+			s.delivered()
+			continue
+		}
+
+		select {
+		case <-s.quit:
+			return
+		case s.ch <- v:
+		}
+		s.delivered()
+	}
+}
+
+// delivered removes the oldest value from the count of pending values, and truncates the
+// file once it is empty so it does not grow forever.
+func (s *spillBuffer[T]) delivered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending--
+	if s.pending > 0 {
+		return
+	}
+	if err := s.w.Truncate(0); err != nil {
+		s.setErr(err)
+	}
+	if _, err := s.w.Seek(0, 0); err != nil {
+		s.setErr(err)
+	}
+	if _, err := s.rf.Seek(0, 0); err != nil {
+		s.setErr(err)
+	}
+	s.r.Reset(s.rf)
+}
+
+func (s *spillBuffer[T]) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.w.Close()
+	s.rf.Close()
+	os.Remove(s.w.Name())
+	if s.closed {
+		s.closeCh.Do(func() { close(s.ch) })
+	}
+	s.stopped.Do(func() { close(s.quit) })
+}
+
+func (s *spillBuffer[T]) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	select {
+	case <-s.quit:
+		// the pump is gone, nobody else is going to close the channel
+		s.closeCh.Do(func() { close(s.ch) })
+	default:
+		s.notify()
+	}
+}
+
+func (s *spillBuffer[T]) stop() {
+	s.stopped.Do(func() { close(s.quit) })
+}
+
+func (s *spillBuffer[T]) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *spillBuffer[T]) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+func (s *spillBuffer[T]) fail(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setErr(err)
+	return err
+}
+
+func (s *spillBuffer[T]) setErr(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *spillBuffer[T]) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,199 @@
+package chapter4
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fill sends 1..n to an edge nobody reads from yet.
+func fill(t *testing.T, e *Edge[int], n int) {
+	t.Helper()
+	done := make(chan interface{})
+	defer close(done)
+	for i := 1; i <= n; i++ {
+		if !e.Send(done, i) {
+			t.Fatalf("Send(%d) returned false", i)
+		}
+	}
+	e.Close()
+}
+
+func drain(e *Edge[int]) []int {
+	var values []int
+	for v := range e.C() {
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestEdgeOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		bp      Backpressure
+		want    string
+		dropped int64
+	}{
+		{bp: Backpressure{Policy: DropNewest}, want: "[1 2 3]", dropped: 7},
+		{bp: Backpressure{Policy: DropOldest}, want: "[8 9 10]", dropped: 7},
+		{bp: Backpressure{Policy: Spill, SpillDir: os.TempDir(), SpillLimit: 4}, want: "[1 2 3 4 5 6 7]", dropped: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bp.Policy.String(), func(t *testing.T) {
+			e, err := NewEdge[int](3, tt.bp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fill(t, e, 10)
+
+			if got := fmt.Sprint(drain(e)); got != tt.want {
+				t.Errorf("received %s, want %s", got, tt.want)
+			}
+			if e.Dropped() != tt.dropped {
+				t.Errorf("dropped %d, want %d", e.Dropped(), tt.dropped)
+			}
+			if err := e.Err(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestEdgeSample(t *testing.T) {
+	e, err := NewEdge[int](2, Backpressure{Policy: Sample, Every: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every third value sent while the buffer is full is kept, so a consumer has to
+	// make room for it.
+	received := make(chan []int)
+	go func() { received <- drain(e) }()
+	fill(t, e, 11)
+
+	values := <-received
+	if int64(len(values))+e.Dropped() != 11 {
+		t.Errorf("received %d and dropped %d, want 11 in total", len(values), e.Dropped())
+	}
+	if e.Dropped() > 6 {
+		t.Errorf("dropped %d values, at most 6 of the 9 overflowing ones should go", e.Dropped())
+	}
+}
+
+func TestEdgeSpillKeepsOrder(t *testing.T) {
+	e, err := NewEdge[string](1, Backpressure{Policy: Spill, SpillDir: t.TempDir(), SpillLimit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+
+	go func() {
+		defer e.Close()
+		for i := 0; i < 500; i++ {
+			e.Send(done, fmt.Sprint(i))
+		}
+	}()
+
+	var i int
+	for v := range e.C() {
+		if v != fmt.Sprint(i) {
+			t.Fatalf("received %q, want %q", v, fmt.Sprint(i))
+		}
+		i++
+	}
+	if i != 500 || e.Dropped() != 0 {
+		t.Fatalf("received %d values and dropped %d, want 500 and 0", i, e.Dropped())
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(`{
+  "stages": [
+    {"name": "numbers", "kind": "generator", "params": {"values": [1, 2, 3, 4, 5, 6, 7, 8]}, "buffer": 2},
+    {"name": "double",  "kind": "multiply",  "params": {"by": 2}, "inputs": ["numbers"], "buffer": 2}
+  ],
+  "edges": [
+    {"from": "numbers", "to": "double", "backpressure": {"policy": "spill", "spill_limit": 16}},
+    {"from": "double", "backpressure": {"policy": "drop-newest"}}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := FromSpec(spec, DefaultRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Wait()
+
+	// nobody reads the output, so double fills its buffer and drops the rest
+	stats := pipeline.EdgeStats()
+	if len(stats) != 2 {
+		t.Fatalf("got %d edges, want 2", len(stats))
+	}
+	if out := stats[1]; out.From != "double" || out.Sent != 2 || out.Dropped != 6 {
+		t.Errorf("output edge %+v, want 2 sent and 6 dropped", out)
+	}
+	if in := stats[0]; in.Dropped != 0 || in.Sent+in.Spilled != 8 {
+		t.Errorf("spill edge %+v, want all 8 values delivered", in)
+	}
+}
+
+func TestBuilderUnknownEdge(t *testing.T) {
+	_, err := NewBuilder().
+		Source("numbers", Values(1)).
+		Stage("inc", Map(func(i int) int { return i + 1 }), "numbers").
+		Edge("inc", "numbers", Backpressure{Policy: DropOldest}).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), `no edge from "inc" to "numbers"`) {
+		t.Fatalf("Build() error = %v", err)
+	}
+}
+
+func TestEdgeUnbuffered(t *testing.T) {
+	// On an unbuffered channel the dropping policies would drop whenever the reader is
+	// not parked on it, or spin forever with DropOldest, so they need a buffer.
+	for _, bp := range []Backpressure{
+		{Policy: DropNewest},
+		{Policy: DropOldest},
+		{Policy: Sample, Every: 2},
+	} {
+		if _, err := NewEdge[int](0, bp); err == nil {
+			t.Errorf("NewEdge(0, %v) succeeded", bp.Policy)
+		}
+	}
+	if _, err := NewEdge[int](0, Backpressure{}); err != nil {
+		t.Errorf("NewEdge(0, block) = %v", err)
+	}
+
+	_, err := NewBuilder().
+		Source("numbers", Values(1)).
+		Stage("inc", Map(func(i int) int { return i + 1 }), "numbers").
+		Edge("numbers", "inc", Backpressure{Policy: DropOldest}).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "needs a buffer") {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	_, err = NewBuilder().
+		Add(StageSpec{Name: "numbers", Buffer: 1}, Values(1)).
+		Stage("inc", Map(func(i int) int { return i + 1 }), "numbers").
+		Edge("numbers", "inc", Backpressure{Policy: DropOldest}).
+		Build()
+	if err != nil {
+		t.Fatalf("Build() with a buffer = %v", err)
+	}
+}
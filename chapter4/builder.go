@@ -0,0 +1,775 @@
+package chapter4
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Declarative pipelines
+//
+// Nesting calls like Multiply(done, Add(done, Multiply(done, intStream, 2), 1), 2) works
+// for three stages, but the shape of the pipeline is hidden inside out. The Builder lets
+// us describe the same pipeline as a list of named stages and the stages they read from:
+//
+//	numbers  -> double -> inc -> double2
+//
+// Each stage can run several workers (fan-out) whose results are merged back into a
+// single stream (fan-in), and a stage read by several others sends every value to each
+// of them. Build checks the description before anything starts: every input exists,
+// there are no cycles and the value types of connected stages match. Start then runs
+// every stage under one cancellation scope.
+
+// Processor is the body of a stage. Use Values or Source to create a source stage and
+// Map to create a stage that transforms values.
+type Processor struct {
+	in     reflect.Type
+	out    reflect.Type
+	source func(done <-chan interface{}) <-chan interface{}
+	fn     func(interface{}) (interface{}, error)
+
+	// newFn, when set, creates the stage function of every worker, and a fresh one after
+	// a restart.
+	newFn func() func(interface{}) (interface{}, error)
+}
+
+// Source creates a processor for a source stage; start is called once when the pipeline
+// starts and must close its channel when it runs out of values or done is closed.
+func Source[T any](start func(done <-chan interface{}) <-chan T) Processor {
+	return Processor{
+		out: reflect.TypeOf((*T)(nil)).Elem(),
+		source: func(done <-chan interface{}) <-chan interface{} {
+			return MapStage(done, start(done), func(v T) interface{} { return v }, StageOptions{})
+		},
+	}
+}
+
+// Values creates a source processor that emits values once, like Generator.
+func Values[T any](values ...T) Processor {
+	return Source(func(done <-chan interface{}) <-chan T {
+		return sliceStream(done, values)
+	})
+}
+
+func sliceStream[T any](done <-chan interface{}, values []T) <-chan T {
+	stream := make(chan T)
+	go func() {
+		defer close(stream)
+		for _, v := range values {
+			select {
+			case <-done:
+				return
+			case stream <- v:
+			}
+		}
+	}()
+	return stream
+}
+
+// Map creates a processor that applies fn to every value it receives.
+func Map[T, U any](fn func(T) U) Processor {
+	return Processor{
+		in:  reflect.TypeOf((*T)(nil)).Elem(),
+		out: reflect.TypeOf((*U)(nil)).Elem(),
+		fn:  func(v interface{}) (interface{}, error) { return fn(v.(T)), nil },
+	}
+}
+
+// Stateful creates a processor whose stage function keeps state between inputs. newFn is
+// called once per worker, so workers never share state, and again whenever the
+// RestartStage policy restarts a worker after a panic.
+func Stateful[T, U any](newFn func() func(T) (U, error)) Processor {
+	wrap := func() func(interface{}) (interface{}, error) {
+		fn := newFn()
+		return func(v interface{}) (interface{}, error) { return fn(v.(T)) }
+	}
+	return Processor{
+		in:    reflect.TypeOf((*T)(nil)).Elem(),
+		out:   reflect.TypeOf((*U)(nil)).Elem(),
+		fn:    wrap(),
+		newFn: wrap,
+	}
+}
+
+// TryMap creates a processor for a function that can fail. Inputs that still fail after
+// the stage's attempts go to the pipeline's dead-letter sink.
+func TryMap[T, U any](fn func(T) (U, error)) Processor {
+	return Processor{
+		in:  reflect.TypeOf((*T)(nil)).Elem(),
+		out: reflect.TypeOf((*U)(nil)).Elem(),
+		fn:  func(v interface{}) (interface{}, error) { return fn(v.(T)) },
+	}
+}
+
+// StageSpec describes one stage of a pipeline. Kind and Params are only used by spec
+// files, stages added with Builder.Add get their processor directly.
+type StageSpec struct {
+	Name    string          `json:"name"`
+	Kind    string          `json:"kind,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Inputs  []string        `json:"inputs,omitempty"`
+	Workers int             `json:"workers,omitempty"`
+	Buffer  int             `json:"buffer,omitempty"`
+
+	// Attempts is how many times a failing input is tried before it becomes a dead
+	// letter, see TryStage.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// EdgeSpec sets the backpressure of the channel between two stages. An empty To means
+// the output of From.
+type EdgeSpec struct {
+	From         string       `json:"from"`
+	To           string       `json:"to,omitempty"`
+	Backpressure Backpressure `json:"backpressure"`
+}
+
+// Spec is the JSON form of a pipeline. Edges not listed block when full.
+type Spec struct {
+	Stages []StageSpec `json:"stages"`
+	Edges  []EdgeSpec  `json:"edges,omitempty"`
+
+	// OnPanic is the panic policy of the whole pipeline.
+	OnPanic PanicPolicy `json:"on_panic,omitempty"`
+}
+
+// ParseSpec decodes a JSON spec. Unknown fields are rejected so typos do not go unnoticed.
+func ParseSpec(r io.Reader) (Spec, error) {
+	var spec Spec
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return Spec{}, fmt.Errorf("chapter4: parse spec: %w", err)
+	}
+	return spec, nil
+}
+
+// ProcessorFactory creates the processor of a spec stage from its params.
+type ProcessorFactory func(params json.RawMessage) (Processor, error)
+
+// Registry maps the kind of a spec stage to the factory creating its processor.
+type Registry map[string]ProcessorFactory
+
+// DefaultRegistry returns a registry with the stages of 5_pipeline_test.go:
+//
+//	generator {"values": [1, 2, 3]}
+//	multiply  {"by": 2}
+//	add       {"n": 1}
+func DefaultRegistry() Registry {
+	return Registry{
+		"generator": func(params json.RawMessage) (Processor, error) {
+			var p struct{ Values []int }
+			if err := decodeParams(params, &p); err != nil {
+				return Processor{}, err
+			}
+			return Values(p.Values...), nil
+		},
+		"multiply": func(params json.RawMessage) (Processor, error) {
+			var p struct{ By int }
+			if err := decodeParams(params, &p); err != nil {
+				return Processor{}, err
+			}
+			return Map(func(i int) int { return i * p.By }), nil
+		},
+		"add": func(params json.RawMessage) (Processor, error) {
+			var p struct{ N int }
+			if err := decodeParams(params, &p); err != nil {
+				return Processor{}, err
+			}
+			return Map(func(i int) int { return i + p.N }), nil
+		},
+	}
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(params, v)
+}
+
+// Builder collects the stages of a pipeline.
+type Builder struct {
+	stages      []stageDef
+	names       map[string]bool
+	edges       []EdgeSpec
+	metrics     *PipelineMetrics
+	deadLetters DeadLetterSink
+	onPanic     PanicPolicy
+	err         error
+}
+
+type stageDef struct {
+	StageSpec
+	proc Processor
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{names: make(map[string]bool)}
+}
+
+// FromSpec returns a Builder holding the stages of spec, with processors created by reg.
+func FromSpec(spec Spec, reg Registry) (*Builder, error) {
+	b := NewBuilder()
+	for _, s := range spec.Stages {
+		factory, ok := reg[s.Kind]
+		if !ok {
+			return nil, fmt.Errorf("chapter4: stage %q: unknown kind %q", s.Name, s.Kind)
+		}
+		proc, err := factory(s.Params)
+		if err != nil {
+			return nil, fmt.Errorf("chapter4: stage %q: %w", s.Name, err)
+		}
+		b.Add(s, proc)
+	}
+	for _, e := range spec.Edges {
+		b.Edge(e.From, e.To, e.Backpressure)
+	}
+	b.OnPanic(spec.OnPanic)
+	return b, nil
+}
+
+// Add appends a stage. Errors are reported by Build, so calls can be chained.
+func (b *Builder) Add(spec StageSpec, p Processor) *Builder {
+	switch {
+	case b.err != nil:
+	case spec.Name == "":
+		b.err = errors.New("chapter4: stage without a name")
+	case b.names[spec.Name]:
+		b.err = fmt.Errorf("chapter4: duplicate stage %q", spec.Name)
+	case p.source == nil && p.fn == nil:
+		b.err = fmt.Errorf("chapter4: stage %q has no processor", spec.Name)
+	default:
+		b.names[spec.Name] = true
+		b.stages = append(b.stages, stageDef{StageSpec: spec, proc: p})
+	}
+	return b
+}
+
+// Source is shorthand for adding a source stage.
+func (b *Builder) Source(name string, p Processor) *Builder {
+	return b.Add(StageSpec{Name: name}, p)
+}
+
+// Stage is shorthand for adding a single worker, unbuffered stage.
+func (b *Builder) Stage(name string, p Processor, inputs ...string) *Builder {
+	return b.Add(StageSpec{Name: name, Inputs: inputs}, p)
+}
+
+// Edge sets the backpressure of the channel from one stage to another. Pass an empty to
+// for the output of a stage nobody reads from.
+func (b *Builder) Edge(from, to string, bp Backpressure) *Builder {
+	b.edges = append(b.edges, EdgeSpec{From: from, To: to, Backpressure: bp})
+	return b
+}
+
+// DeadLetters sends the inputs every stage gives up on to sink.
+func (b *Builder) DeadLetters(sink DeadLetterSink) *Builder {
+	b.deadLetters = sink
+	return b
+}
+
+// OnPanic sets what the pipeline does when a stage function panics. The default is
+// SkipItem.
+func (b *Builder) OnPanic(policy PanicPolicy) *Builder {
+	b.onPanic = policy
+	return b
+}
+
+// Instrument makes every stage of the built pipeline report to m, under its stage name.
+func (b *Builder) Instrument(m *PipelineMetrics) *Builder {
+	b.metrics = m
+	return b
+}
+
+// Build validates the stages and returns a pipeline ready to start.
+func (b *Builder) Build() (*Pipeline, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	byName := make(map[string]*stageDef, len(b.stages))
+	for i := range b.stages {
+		byName[b.stages[i].Name] = &b.stages[i]
+	}
+
+	for _, s := range b.stages {
+		if s.Workers < 0 || s.Buffer < 0 || s.Attempts < 0 {
+			return nil, fmt.Errorf("chapter4: stage %q: negative workers, buffer or attempts", s.Name)
+		}
+		if s.proc.source != nil {
+			if len(s.Inputs) > 0 {
+				return nil, fmt.Errorf("chapter4: source stage %q cannot have inputs", s.Name)
+			}
+			continue
+		}
+		if len(s.Inputs) == 0 {
+			return nil, fmt.Errorf("chapter4: stage %q has no inputs", s.Name)
+		}
+		for _, name := range s.Inputs {
+			from, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("chapter4: stage %q reads from unknown stage %q", s.Name, name)
+			}
+			if !from.proc.out.AssignableTo(s.proc.in) {
+				return nil, fmt.Errorf("chapter4: stage %q expects %v but %q produces %v",
+					s.Name, s.proc.in, name, from.proc.out)
+			}
+		}
+	}
+
+	order, err := topoSort(b.stages)
+	if err != nil {
+		return nil, err
+	}
+
+	backpressure := make(map[[2]string]Backpressure, len(b.edges))
+	for _, e := range b.edges {
+		if !b.hasEdge(e.From, e.To) {
+			return nil, fmt.Errorf("chapter4: no edge from %q to %q", e.From, e.To)
+		}
+		if err := e.Backpressure.validate(byName[e.From].Buffer); err != nil {
+			return nil, fmt.Errorf("chapter4: edge from %q to %q: %w", e.From, e.To, err)
+		}
+		backpressure[[2]string{e.From, e.To}] = e.Backpressure
+	}
+
+	return &Pipeline{
+		order:        order,
+		backpressure: backpressure,
+		metrics:      b.metrics,
+		deadLetters:  b.deadLetters,
+		onPanic:      b.onPanic,
+		restarts:     make(map[string]int),
+	}, nil
+}
+
+// hasEdge reports whether stage to reads from stage from, or, with an empty to, whether
+// from is read by nobody.
+func (b *Builder) hasEdge(from, to string) bool {
+	if !b.names[from] {
+		return false
+	}
+	for _, s := range b.stages {
+		for _, in := range s.Inputs {
+			if in != from {
+				continue
+			}
+			if s.Name == to {
+				return true
+			}
+			if to == "" {
+				return false
+			}
+		}
+	}
+	return to == ""
+}
+
+// topoSort orders the stages so that every stage comes after its inputs, or reports the
+// stages taking part in a cycle.
+func topoSort(stages []stageDef) ([]stageDef, error) {
+	pending := make(map[string]int, len(stages))
+	readers := make(map[string][]string)
+	for _, s := range stages {
+		pending[s.Name] = len(s.Inputs)
+		for _, in := range s.Inputs {
+			readers[in] = append(readers[in], s.Name)
+		}
+	}
+
+	byName := make(map[string]stageDef, len(stages))
+	var ready []string
+	for _, s := range stages {
+		byName[s.Name] = s
+		if len(s.Inputs) == 0 {
+			ready = append(ready, s.Name)
+		}
+	}
+
+	order := make([]stageDef, 0, len(stages))
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, byName[name])
+		for _, r := range readers[name] {
+			pending[r]--
+			if pending[r] == 0 {
+				ready = append(ready, r)
+			}
+		}
+	}
+
+	if len(order) != len(stages) {
+		var cycle []string
+		for name, n := range pending {
+			if n > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("chapter4: cycle between stages %v", cycle)
+	}
+	return order, nil
+}
+
+// Pipeline is a validated set of stages. A Pipeline can be started once.
+type Pipeline struct {
+	order        []stageDef
+	backpressure map[[2]string]Backpressure
+	metrics      *PipelineMetrics
+	deadLetters  DeadLetterSink
+	onPanic      PanicPolicy
+
+	done       chan interface{}
+	cancelOnce sync.Once
+	sourceDone chan interface{}
+	stopOnce   sync.Once
+	drained    atomic.Bool
+	inFlight   atomic.Int64
+	completed  atomic.Int64
+	failed     atomic.Int64
+	mu         sync.Mutex
+	err        error
+	restarts   map[string]int
+	wg         sync.WaitGroup
+	started    time.Time
+	edges      []*edge
+	outputs    map[string]<-chan interface{}
+}
+
+// edge is the channel between two stages. An edge with an empty to is a pipeline output.
+type edge struct {
+	from, to string
+	*Edge[interface{}]
+}
+
+// Start runs every stage. The pipeline stops when parent is closed or Cancel is called,
+// whichever happens first. Start only fails when an edge cannot be created, e.g. because
+// its spill file cannot be opened. It panics if called twice.
+func (p *Pipeline) Start(parent <-chan interface{}) error {
+	if p.done != nil {
+		panic("chapter4: pipeline started twice")
+	}
+	p.done = make(chan interface{})
+	p.sourceDone = make(chan interface{})
+	p.started = time.Now()
+
+	// One edge for every (input, stage) pair, plus one for every stage nobody reads
+	// from. Every stage sends each value to all of its outgoing edges.
+	for _, s := range p.order {
+		for _, name := range s.Inputs {
+			p.edges = append(p.edges, &edge{from: name, to: s.Name})
+		}
+	}
+	for _, s := range p.order {
+		if !p.hasReaders(s.Name) {
+			p.edges = append(p.edges, &edge{from: s.Name})
+		}
+	}
+
+	// The buffer of an edge is set by the stage writing to it, the backpressure by the
+	// edge itself.
+	p.outputs = make(map[string]<-chan interface{})
+	for _, e := range p.edges {
+		var err error
+		from := p.stage(e.from)
+		e.Edge, err = newEdge(from.Buffer, p.backpressure[[2]string{e.from, e.to}], decoderOf(from.proc.out))
+		if err != nil {
+			p.Cancel()
+			for _, opened := range p.edges {
+				if opened.Edge != nil {
+					opened.stop()
+				}
+			}
+			return fmt.Errorf("chapter4: edge from %q to %q: %w", e.from, e.to, err)
+		}
+		if e.to == "" {
+			p.outputs[e.from] = e.C()
+		}
+	}
+
+	go func() {
+		select {
+		case <-parent:
+			p.Cancel()
+		case <-p.done:
+		}
+		p.stopSources()
+		if p.drained.Load() {
+			return
+		}
+		for _, e := range p.edges {
+			e.stop()
+		}
+	}()
+
+	for _, s := range p.order {
+		var ins []<-chan interface{}
+		var outs []*edge
+		for _, e := range p.edges {
+			if e.to == s.Name {
+				ins = append(ins, e.C())
+			}
+			if e.from == s.Name {
+				outs = append(outs, e)
+			}
+		}
+
+		p.startStage(s, FanIn(p.done, ins...), outs)
+	}
+	return nil
+}
+
+func (p *Pipeline) hasReaders(name string) bool {
+	for _, e := range p.edges {
+		if e.from == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pipeline) stage(name string) stageDef {
+	for _, s := range p.order {
+		if s.Name == name {
+			return s
+		}
+	}
+	panic("chapter4: unknown stage " + name)
+}
+
+// decoderOf returns a function decoding spilled JSON back into a value of type t, so a
+// spilled int comes back as an int rather than a float64.
+func decoderOf(t reflect.Type) func([]byte) (interface{}, error) {
+	return func(b []byte) (interface{}, error) {
+		v := reflect.New(t)
+		if err := json.Unmarshal(b, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Elem().Interface(), nil
+	}
+}
+
+func (p *Pipeline) startStage(s stageDef, in <-chan interface{}, outs []*edge) {
+	var opts StageOptions
+	if p.metrics != nil {
+		opts.Metrics = p.metrics.Stage(s.Name)
+	}
+
+	dl := DeadLetterOptions{Stage: s.Name, Attempts: s.Attempts, Sink: p.countFailed()}
+	if p.onPanic == AbortPipeline {
+		dl.OnPanic = p.abort
+	}
+
+	var results <-chan interface{}
+	if s.proc.source != nil {
+		results = s.proc.source(p.sourceDone)
+	} else {
+		workers := make([]<-chan interface{}, max(s.Workers, 1))
+		for i := range workers {
+			workers[i] = p.startWorker(s, in, dl, opts)
+		}
+		results = FanIn(p.done, workers...)
+	}
+
+	var readers, outputs int64
+	for _, out := range outs {
+		if out.to == "" {
+			outputs++
+		} else {
+			readers++
+		}
+	}
+	// every value a stage sends on replaces the input it came from, sources have no input
+	var consumed int64 = 1
+	if s.proc.source != nil {
+		consumed = 0
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			for _, out := range outs {
+				out.Close()
+			}
+		}()
+
+		for v := range results {
+			for _, out := range outs {
+				if !out.Send(p.done, v) {
+					// wait for the workers, so Wait really means every goroutine has stopped
+					for range results {
+					}
+					return
+				}
+			}
+			p.inFlight.Add(readers - consumed)
+			p.completed.Add(outputs)
+		}
+	}()
+}
+
+// countFailed wraps the dead-letter sink, so inputs that fail leave the in-flight count.
+func (p *Pipeline) countFailed() DeadLetterSink {
+	return FuncSink(func(d DeadLetter) error {
+		p.failed.Add(1)
+		p.inFlight.Add(-1)
+		if p.deadLetters == nil {
+			DeadLetterOptions{}.send(d)
+			return nil
+		}
+		return p.deadLetters.Send(d)
+	})
+}
+
+// startWorker starts one worker of s. With RestartStage a worker whose function panicked
+// carries on with a fresh one, created by the processor's newFn when it has one.
+func (p *Pipeline) startWorker(
+	s stageDef,
+	in <-chan interface{},
+	dl DeadLetterOptions,
+	opts StageOptions,
+) <-chan interface{} {
+	fn := s.proc.fn
+	if s.proc.newFn != nil {
+		fn = s.proc.newFn()
+	}
+
+	if p.onPanic == RestartStage {
+		dl.OnPanic = func(*PanicError) {
+			p.mu.Lock()
+			p.restarts[s.Name]++
+			p.mu.Unlock()
+			if s.proc.newFn != nil {
+				fn = s.proc.newFn()
+			}
+		}
+	}
+
+	// fn is only swapped by OnPanic, which runs on the worker goroutine itself
+	return TryStage(p.done, in, func(v interface{}) (interface{}, error) {
+		return fn(v)
+	}, dl, opts)
+}
+
+func (p *Pipeline) abort(err *PanicError) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.Cancel()
+}
+
+// Err returns the panic that aborted the pipeline, if any.
+func (p *Pipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Restarts returns how many times workers of a stage were restarted after a panic.
+func (p *Pipeline) Restarts(stage string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarts[stage]
+}
+
+// Output returns the stream of a stage no other stage reads from. It returns nil for
+// unknown stages and before Start.
+func (p *Pipeline) Output(name string) <-chan interface{} {
+	return p.outputs[name]
+}
+
+// Outputs returns the names of the stages no other stage reads from.
+func (p *Pipeline) Outputs() []string {
+	names := make([]string, 0, len(p.outputs))
+	for name := range p.outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EdgeStats is a snapshot of one edge of a running pipeline.
+type EdgeStats struct {
+	From    string
+	To      string
+	Policy  OverflowPolicy
+	Len     int
+	Cap     int
+	Sent    int64
+	Dropped int64
+	Spilled int64
+}
+
+// EdgeStats returns a snapshot of every edge, in the order the stages were wired up.
+func (p *Pipeline) EdgeStats() []EdgeStats {
+	stats := make([]EdgeStats, 0, len(p.edges))
+	for _, e := range p.edges {
+		stats = append(stats, EdgeStats{
+			From:    e.from,
+			To:      e.to,
+			Policy:  e.bp.Policy,
+			Len:     e.Len(),
+			Cap:     e.Cap(),
+			Sent:    e.Sent(),
+			Dropped: e.Dropped(),
+			Spilled: e.Spilled(),
+		})
+	}
+	return stats
+}
+
+// Cancel stops every stage. It is safe to call more than once.
+func (p *Pipeline) Cancel() {
+	p.cancelOnce.Do(func() { close(p.done) })
+}
+
+// Wait blocks until every stage has stopped. Outputs must be drained, or the pipeline
+// cancelled, for Wait to return.
+func (p *Pipeline) Wait() {
+	p.wg.Wait()
+}
+
+// FanIn merges several channels into one, which is closed once all of them are.
+func FanIn[T any](done <-chan interface{}, channels ...<-chan T) <-chan T {
+	if len(channels) == 1 {
+		return channels[0]
+	}
+
+	var wg sync.WaitGroup
+	multiplexedStream := make(chan T)
+
+	multiplex := func(c <-chan T) {
+		defer wg.Done()
+		for v := range c {
+			select {
+			case <-done:
+				return
+			case multiplexedStream <- v:
+			}
+		}
+	}
+
+	wg.Add(len(channels))
+	for _, c := range channels {
+		go multiplex(c)
+	}
+
+	go func() {
+		wg.Wait()
+		close(multiplexedStream)
+	}()
+
+	return multiplexedStream
+}
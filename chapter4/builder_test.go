@@ -0,0 +1,175 @@
+package chapter4
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func collect(stream <-chan interface{}) []int {
+	var values []int
+	for v := range stream {
+		values = append(values, v.(int))
+	}
+	sort.Ints(values)
+	return values
+}
+
+func TestBuilder(t *testing.T) {
+	// Same pipeline as TestPipelineV1, without the nesting
+	double := Map(func(i int) int { return i * 2 })
+	pipeline, err := NewBuilder().
+		Source("numbers", Values(1, 2, 3, 4)).
+		Stage("double", double, "numbers").
+		Stage("inc", Map(func(i int) int { return i + 1 }), "double").
+		Stage("double2", double, "inc").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(pipeline.Outputs()); got != "[double2]" {
+		t.Fatalf("outputs = %s", got)
+	}
+	if got := fmt.Sprint(collect(pipeline.Output("double2"))); got != "[6 10 14 18]" {
+		t.Fatalf("pipeline produced %s", got)
+	}
+	pipeline.Wait()
+}
+
+const fanOutSpec = `{
+  "stages": [
+    {"name": "numbers", "kind": "generator", "params": {"values": [1, 2, 3, 4, 5, 6]}},
+    {"name": "double",  "kind": "multiply",  "params": {"by": 2}, "inputs": ["numbers"], "workers": 3, "buffer": 2},
+    {"name": "inc",     "kind": "add",       "params": {"n": 1},  "inputs": ["numbers"]},
+    {"name": "merged",  "kind": "add",       "inputs": ["double", "inc"], "workers": 2}
+  ]
+}`
+
+func TestBuilderFromSpec(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(fanOutSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := FromSpec(spec, DefaultRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewPipelineMetrics()
+	pipeline, err := b.Instrument(metrics).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+
+	// numbers is read by both double and inc, and merged fans both back in
+	got := fmt.Sprint(collect(pipeline.Output("merged")))
+	if got != "[2 2 3 4 4 5 6 6 7 8 10 12]" {
+		t.Fatalf("pipeline produced %s", got)
+	}
+	pipeline.Wait()
+
+	if s := metrics.Stage("double").Snapshot(); s.ItemsIn != 6 {
+		t.Errorf("double received %d items, want 6", s.ItemsIn)
+	}
+}
+
+func TestBuilderValidation(t *testing.T) {
+	toString := Map(func(i int) string { return strconv.Itoa(i) })
+	inc := Map(func(i int) int { return i + 1 })
+
+	tests := []struct {
+		name    string
+		builder *Builder
+		want    string
+	}{
+		{
+			name:    "unknown input",
+			builder: NewBuilder().Source("numbers", Values(1)).Stage("inc", inc, "nope"),
+			want:    `unknown stage "nope"`,
+		},
+		{
+			name: "type mismatch",
+			builder: NewBuilder().Source("numbers", Values(1)).
+				Stage("str", toString, "numbers").
+				Stage("inc", inc, "str"),
+			want: `"inc" expects int but "str" produces string`,
+		},
+		{
+			name: "cycle",
+			builder: NewBuilder().Source("numbers", Values(1)).
+				Stage("a", inc, "numbers", "b").
+				Stage("b", inc, "a"),
+			want: "cycle between stages [a b]",
+		},
+		{
+			name:    "duplicate",
+			builder: NewBuilder().Source("numbers", Values(1)).Source("numbers", Values(2)),
+			want:    `duplicate stage "numbers"`,
+		},
+		{
+			name:    "no inputs",
+			builder: NewBuilder().Stage("inc", inc),
+			want:    `"inc" has no inputs`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.builder.Build()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Build() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuilderCancel(t *testing.T) {
+	forever := Source(func(done <-chan interface{}) <-chan int {
+		stream := make(chan int)
+		go func() {
+			defer close(stream)
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				case stream <- i:
+				}
+			}
+		}()
+		return stream
+	})
+
+	pipeline, err := NewBuilder().
+		Source("numbers", forever).
+		Add(StageSpec{Name: "inc", Inputs: []string{"numbers"}, Workers: 4}, Map(func(i int) int { return i + 1 })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		<-pipeline.Output("inc")
+	}
+
+	// closing the parent scope stops every stage, even though nobody reads the output
+	close(done)
+	pipeline.Wait()
+}
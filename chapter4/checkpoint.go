@@ -0,0 +1,296 @@
+package chapter4
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Checkpointing
+//
+// A Generator-fed pipeline keeps no record of how far it got: if the process dies halfway,
+// the only option is to start over. A Checkpointer remembers, for every source, the offset
+// of the next value to read, and persists it together with any state the stages want to
+// keep. A restarted pipeline asks the Checkpointer where to resume.
+//
+// An offset only moves forward once the sink acknowledged the value, and all values before
+// it, so a value is never lost. Values acknowledged after the last commit are processed
+// again after a restart: the pipeline is at-least-once, not exactly-once. The same goes
+// for stage state, which may already include values that will be replayed.
+//
+// The file is written to a temporary file in the same directory and renamed over the old
+// one, so a crash during a commit leaves either the old or the new checkpoint behind,
+// never half of each.
+//
+// A Checkpointer is not tied to Builder or Pipeline, nothing acknowledges or commits on
+// its own: the caller acks every value that left the pipeline and commits, with Commit or
+// the interval given to OpenCheckpointer.
+
+// checkpointFile is the on-disk format of a checkpoint.
+type checkpointFile struct {
+	Offsets map[string]int64           `json:"offsets"`
+	State   map[string]json.RawMessage `json:"state,omitempty"`
+	Saved   time.Time                  `json:"saved"`
+}
+
+// Checkpointer tracks and persists the progress of a pipeline.
+type Checkpointer struct {
+	path string
+
+	// commitMu keeps a slow commit from renaming an older snapshot over a newer one
+	commitMu sync.Mutex
+
+	mu      sync.Mutex
+	sources map[string]*sourceProgress
+	state   map[string]json.RawMessage
+	dirty   bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// sourceProgress tracks the acknowledged offsets of one source. Values can be
+// acknowledged out of order when a stage runs several workers, next only moves past
+// offsets that were all acknowledged. committed is next as of the last commit.
+type sourceProgress struct {
+	next      int64
+	committed int64
+	acked     map[int64]bool
+}
+
+// OpenCheckpointer loads the checkpoint at path, or starts from scratch when the file does
+// not exist yet. With a positive interval the checkpoint is committed in the background
+// at that interval until Close.
+func OpenCheckpointer(path string, interval time.Duration) (*Checkpointer, error) {
+	c := &Checkpointer{
+		path:    path,
+		sources: make(map[string]*sourceProgress),
+		state:   make(map[string]json.RawMessage),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var f checkpointFile
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("chapter4: corrupt checkpoint %s: %w", path, err)
+		}
+		for name, next := range f.Offsets {
+			c.sources[name] = &sourceProgress{next: next, committed: next, acked: make(map[int64]bool)}
+		}
+		for name, s := range f.State {
+			c.state[name] = s
+		}
+	}
+
+	if interval <= 0 {
+		close(c.stopped)
+		return c, nil
+	}
+
+	go func() {
+		defer close(c.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				// a failed periodic commit is retried on the next tick, and reported by
+				// the final Commit in Close
+				c.Commit()
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (c *Checkpointer) source(name string) *sourceProgress {
+	s, ok := c.sources[name]
+	if !ok {
+		s = &sourceProgress{acked: make(map[int64]bool)}
+		c.sources[name] = s
+	}
+	return s
+}
+
+// Offset returns the first offset of a source that was not acknowledged yet, committed or
+// not. It is the progress of the running pipeline; after a crash it resumes from
+// CommittedOffset.
+func (c *Checkpointer) Offset(source string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.source(source).next
+}
+
+// CommittedOffset returns the offset a source should resume from: the first value that
+// was not acknowledged before the last commit.
+func (c *Checkpointer) CommittedOffset(source string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.source(source).committed
+}
+
+// Ack marks the value at offset of source as fully processed.
+func (c *Checkpointer) Ack(source string, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.source(source)
+	if offset < s.next {
+		return
+	}
+	s.acked[offset] = true
+	for s.acked[s.next] {
+		delete(s.acked, s.next)
+		s.next++
+		c.dirty = true
+	}
+}
+
+// SetState stores the state of a stage, encoded as JSON, with the next commit.
+func (c *Checkpointer) SetState(stage string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state[stage] = b
+	c.dirty = true
+	return nil
+}
+
+// State decodes the last stored state of a stage into v. It reports false when the stage
+// has no state yet.
+func (c *Checkpointer) State(stage string, v interface{}) (bool, error) {
+	c.mu.Lock()
+	b, ok := c.state[stage]
+	c.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+// Commit writes the checkpoint to disk if anything changed since the last commit.
+func (c *Checkpointer) Commit() error {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	f := checkpointFile{
+		Offsets: make(map[string]int64, len(c.sources)),
+		State:   make(map[string]json.RawMessage, len(c.state)),
+		Saved:   time.Now(),
+	}
+	for name, s := range c.sources {
+		f.Offsets[name] = s.next
+	}
+	// committed only moves once the file is on disk
+	offsets := f.Offsets
+	for name, s := range c.state {
+		f.State[name] = s
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err := writeFileAtomic(c.path, f); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+
+	c.mu.Lock()
+	for name, next := range offsets {
+		c.sources[name].committed = next
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Close stops the background commits and commits one last time.
+func (c *Checkpointer) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	<-c.stopped
+	return c.Commit()
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Checkpointed is a value read from a checkpointed source, together with where it came
+// from. Pass Source and Offset to Checkpointer.Ack once the value has left the pipeline.
+type Checkpointed[T any] struct {
+	Value  T
+	Source string
+	Offset int64
+}
+
+// CheckpointedGenerator is Generator with a memory: it emits the values of source that
+// were not acknowledged before the last commit of cp.
+func CheckpointedGenerator[T any](
+	done <-chan interface{},
+	cp *Checkpointer,
+	source string,
+	values ...T,
+) <-chan Checkpointed[T] {
+	stream := make(chan Checkpointed[T])
+
+	go func() {
+		defer close(stream)
+
+		for offset := cp.CommittedOffset(source); offset < int64(len(values)); offset++ {
+			item := Checkpointed[T]{Value: values[offset], Source: source, Offset: offset}
+			select {
+			case <-done:
+				return
+			case stream <- item:
+			}
+		}
+	}()
+
+	return stream
+}
@@ -0,0 +1,145 @@
+package chapter4
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline.checkpoint")
+	numbers := []int{1, 2, 3, 4, 5, 6, 7, 8}
+
+	double := func(done <-chan interface{}, in <-chan Checkpointed[int]) <-chan Checkpointed[int] {
+		return MapStage(done, in, func(c Checkpointed[int]) Checkpointed[int] {
+			c.Value *= 2
+			return c
+		}, StageOptions{})
+	}
+
+	// First run: the process "dies" after the sink handled three values
+	cp, err := OpenCheckpointer(path, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan interface{})
+	var sum int
+	for item := range double(done, CheckpointedGenerator(done, cp, "numbers", numbers...)) {
+		sum += item.Value
+		cp.Ack(item.Source, item.Offset)
+		if err := cp.SetState("sum", sum); err != nil {
+			t.Fatal(err)
+		}
+		if item.Offset == 2 {
+			break
+		}
+	}
+	close(done)
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second run: resume where the first one stopped, with the state it left behind
+	cp, err = OpenCheckpointer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := cp.Offset("numbers"); off != 3 {
+		t.Fatalf("resuming from offset %d, want 3", off)
+	}
+	sum = 0
+	if ok, err := cp.State("sum", &sum); !ok || err != nil {
+		t.Fatalf("State() = %v, %v", ok, err)
+	}
+
+	done = make(chan interface{})
+	defer close(done)
+	var resumed []int
+	for item := range double(done, CheckpointedGenerator(done, cp, "numbers", numbers...)) {
+		sum += item.Value
+		resumed = append(resumed, item.Value)
+		cp.Ack(item.Source, item.Offset)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(resumed) != "[8 10 12 14 16]" {
+		t.Errorf("second run processed %v", resumed)
+	}
+	if sum != 72 {
+		t.Errorf("sum = %d, want 72", sum)
+	}
+}
+
+func TestCheckpointOutOfOrderAck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline.checkpoint")
+	cp, err := OpenCheckpointer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// offset 1 is still in flight, so only offset 0 is safe to commit
+	cp.Ack("numbers", 0)
+	cp.Ack("numbers", 2)
+	cp.Ack("numbers", 3)
+	if err := cp.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenCheckpointer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := reopened.Offset("numbers"); off != 1 {
+		t.Fatalf("committed offset %d, want 1", off)
+	}
+
+	cp.Ack("numbers", 1)
+	if off := cp.Offset("numbers"); off != 4 {
+		t.Fatalf("offset after the gap closed is %d, want 4", off)
+	}
+	// a crash now would resume from the last commit
+	if off := cp.CommittedOffset("numbers"); off != 1 {
+		t.Fatalf("committed offset before the next commit is %d, want 1", off)
+	}
+	if err := cp.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if off := cp.CommittedOffset("numbers"); off != 4 {
+		t.Fatalf("committed offset after the commit is %d, want 4", off)
+	}
+}
+
+func TestCheckpointAtomicCommit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pipeline.checkpoint")
+
+	cp, err := OpenCheckpointer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i++ {
+		cp.Ack("numbers", i)
+		if err := cp.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "pipeline.checkpoint" {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCheckpointer(path, 0); err == nil {
+		t.Fatal("opening a corrupt checkpoint succeeded")
+	}
+}
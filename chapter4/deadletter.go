@@ -0,0 +1,323 @@
+package chapter4
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Dead letters
+//
+// TestErrorV2 sends errors downstream as a Result, where the consumer prints them and moves
+// on: the input that failed is gone. A stage started with TryStage instead retries a
+// failing input a few times and then hands it, with the error, the attempt count and the
+// stage name, to a DeadLetterSink. From there it can be inspected, and replayed into the
+// pipeline once the cause is fixed.
+
+// DeadLetter is an input a stage gave up on.
+type DeadLetter struct {
+	Stage   string
+	Attempt int
+	Err     error
+	Input   interface{}
+	Time    time.Time
+}
+
+// deadLetterJSON is the JSON form of a DeadLetter, with the error as a string.
+type deadLetterJSON struct {
+	Stage   string      `json:"stage"`
+	Attempt int         `json:"attempt"`
+	Error   string      `json:"error"`
+	Input   interface{} `json:"input"`
+	Time    time.Time   `json:"time"`
+}
+
+// MarshalJSON encodes the error as its message.
+func (d DeadLetter) MarshalJSON() ([]byte, error) {
+	j := deadLetterJSON{Stage: d.Stage, Attempt: d.Attempt, Input: d.Input, Time: d.Time}
+	if d.Err != nil {
+		j.Error = d.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a dead letter written by MarshalJSON. Input is left as a
+// json.RawMessage, since only the stage knows its type.
+func (d *DeadLetter) UnmarshalJSON(b []byte) error {
+	var j struct {
+		deadLetterJSON
+		Input json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*d = DeadLetter{
+		Stage:   j.Stage,
+		Attempt: j.Attempt,
+		Input:   j.Input,
+		Time:    j.Time,
+	}
+	if j.Error != "" {
+		d.Err = errors.New(j.Error)
+	}
+	return nil
+}
+
+// DeadLetterSink receives the dead letters of one or more stages. Send is called from the
+// stage goroutines, so implementations must be safe for concurrent use.
+type DeadLetterSink interface {
+	Send(DeadLetter) error
+}
+
+// ChanSink sends dead letters on a channel. Send blocks the stage until the letter is
+// received, so the channel should be buffered or read by its own goroutine.
+type ChanSink chan<- DeadLetter
+
+// Send implements DeadLetterSink.
+func (c ChanSink) Send(d DeadLetter) error {
+	c <- d
+	return nil
+}
+
+// FuncSink calls a function for every dead letter.
+type FuncSink func(DeadLetter) error
+
+// Send implements DeadLetterSink.
+func (f FuncSink) Send(d DeadLetter) error {
+	return f(d)
+}
+
+// JSONLinesSink writes every dead letter as one JSON object per line.
+type JSONLinesSink struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewJSONLinesSink returns a sink writing to w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{enc: json.NewEncoder(w)}
+}
+
+// OpenJSONLinesSink opens the file at path for appending, creating it if needed, and
+// returns a sink writing to it. The file is closed by Close.
+func OpenJSONLinesSink(path string) (*JSONLinesSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := NewJSONLinesSink(f)
+	s.closer = f
+	return s, nil
+}
+
+// Send implements DeadLetterSink.
+func (s *JSONLinesSink) Send(d DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(d)
+}
+
+// Close closes the underlying file if the sink was created by OpenJSONLinesSink.
+func (s *JSONLinesSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// ReadDeadLetters decodes the dead letters written by a JSONLinesSink.
+func ReadDeadLetters(r io.Reader) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var d DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("chapter4: dead letter on line %d: %w", line, err)
+		}
+		letters = append(letters, d)
+	}
+	return letters, scanner.Err()
+}
+
+// DeadLetterOptions configures how TryStage handles failing inputs.
+type DeadLetterOptions struct {
+	// Stage is the stage name recorded in the dead letters.
+	Stage string
+
+	// Attempts is how many times an input is tried before it becomes a dead letter.
+	// Values below 1 mean a single attempt.
+	Attempts int
+
+	// Backoff is the wait before the second attempt, doubled for every attempt after
+	// that.
+	Backoff time.Duration
+
+	// Sink receives the dead letters. Without a sink, or when the sink fails, the dead
+	// letter is logged and dropped.
+	Sink DeadLetterSink
+
+	// OnPanic is called after a panicking input was turned into a dead letter, on the
+	// goroutine of the stage.
+	OnPanic func(*PanicError)
+}
+
+// TryStage is MapStage for functions that can fail. An input for which fn keeps failing
+// is not sent on, it is handed to the dead-letter sink instead. A panic in fn fails the
+// input right away, with a *PanicError.
+func TryStage[T, U any](
+	done <-chan interface{},
+	in <-chan T,
+	fn func(T) (U, error),
+	dl DeadLetterOptions,
+	opts StageOptions,
+) <-chan U {
+	attempts := max(dl.Attempts, 1)
+
+	return mapStage(done, in, func(v T) (U, bool) {
+		var err error
+		attempt := 1
+		for backoff := dl.Backoff; ; backoff *= 2 {
+			var result U
+			if result, err = protect(dl.Stage, fn, v); err == nil {
+				return result, true
+			}
+			if _, panicked := err.(*PanicError); panicked {
+				break
+			}
+			if attempt == attempts || !sleep(done, backoff) {
+				break
+			}
+			attempt++
+		}
+
+		dl.send(DeadLetter{Stage: dl.Stage, Attempt: attempt, Err: err, Input: v, Time: time.Now()})
+		if pe, panicked := err.(*PanicError); panicked && dl.OnPanic != nil {
+			dl.OnPanic(pe)
+		}
+		var zero U
+		return zero, false
+	}, opts)
+}
+
+func (dl DeadLetterOptions) send(d DeadLetter) {
+	if dl.Sink == nil {
+		log.Printf("dead letter from stage %q after %d attempts: %v", d.Stage, d.Attempt, d.Err)
+		return
+	}
+	if err := dl.Sink.Send(d); err != nil {
+		log.Printf("cannot send dead letter from stage %q: %v (input error: %v)", d.Stage, err, d.Err)
+	}
+}
+
+// sleep waits for d, and reports false if done was closed first.
+func sleep(done <-chan interface{}, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Replay returns a builder for the part of b's pipeline that starts at the stages the
+// letters came from. Each of those stages reads the inputs of its letters instead of its
+// own inputs, and every stage downstream of them runs as before, so replayed values end
+// up in the same outputs as the original ones would have.
+func (b *Builder) Replay(letters []DeadLetter) (*Builder, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	byName := make(map[string]stageDef, len(b.stages))
+	for _, s := range b.stages {
+		byName[s.Name] = s
+	}
+
+	inputs := make(map[string][]interface{})
+	for _, d := range letters {
+		s, ok := byName[d.Stage]
+		if !ok {
+			return nil, fmt.Errorf("chapter4: dead letter from unknown stage %q", d.Stage)
+		}
+		if s.proc.source != nil {
+			return nil, fmt.Errorf("chapter4: cannot replay into source stage %q", d.Stage)
+		}
+
+		v := d.Input
+		if raw, ok := v.(json.RawMessage); ok {
+			var err error
+			if v, err = decoderOf(s.proc.in)(raw); err != nil {
+				return nil, fmt.Errorf("chapter4: dead letter for stage %q: %w", d.Stage, err)
+			}
+		}
+		inputs[d.Stage] = append(inputs[d.Stage], v)
+	}
+
+	keep := make(map[string]bool)
+	for name := range inputs {
+		keep[name] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range b.stages {
+			for _, in := range s.Inputs {
+				if keep[in] && !keep[s.Name] {
+					keep[s.Name] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	r := NewBuilder()
+	r.metrics = b.metrics
+	r.deadLetters = b.deadLetters
+	r.onPanic = b.onPanic
+	for _, s := range b.stages {
+		if !keep[s.Name] {
+			continue
+		}
+
+		spec := s.StageSpec
+		spec.Inputs = nil
+		if values, ok := inputs[s.Name]; ok {
+			source := "replay:" + s.Name
+			r.Add(StageSpec{Name: source}, Processor{
+				out: s.proc.in,
+				source: func(done <-chan interface{}) <-chan interface{} {
+					return sliceStream(done, values)
+				},
+			})
+			spec.Inputs = append(spec.Inputs, source)
+		}
+		for _, in := range s.Inputs {
+			if keep[in] {
+				spec.Inputs = append(spec.Inputs, in)
+			}
+		}
+		r.Add(spec, s.proc)
+	}
+
+	for _, e := range b.edges {
+		if keep[e.From] && (e.To == "" || keep[e.To]) {
+			r.edges = append(r.edges, e)
+		}
+	}
+	return r, r.err
+}
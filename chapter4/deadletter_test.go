@@ -0,0 +1,139 @@
+package chapter4
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+var errOdd = errors.New("odd number")
+
+func TestTryStage(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	// 3 fails twice and then succeeds, the other odd numbers always fail
+	var tries atomic.Int32
+	half := func(i int) (int, error) {
+		if i == 3 && tries.Add(1) > 2 {
+			return 1, nil
+		}
+		if i%2 != 0 {
+			return 0, errOdd
+		}
+		return i / 2, nil
+	}
+
+	letters := make(chan DeadLetter, 10)
+	results := TryStage(done, Generator(done, 1, 2, 3, 4, 5), half,
+		DeadLetterOptions{Stage: "half", Attempts: 3, Sink: ChanSink(letters)},
+		StageOptions{})
+
+	var got []int
+	for v := range results {
+		got = append(got, v)
+	}
+	close(letters)
+
+	if fmt.Sprint(got) != "[1 1 2]" {
+		t.Errorf("results = %v, want [1 1 2]", got)
+	}
+
+	var inputs []interface{}
+	for d := range letters {
+		if d.Stage != "half" || d.Attempt != 3 || !errors.Is(d.Err, errOdd) {
+			t.Errorf("unexpected dead letter %+v", d)
+		}
+		inputs = append(inputs, d.Input)
+	}
+	if fmt.Sprint(inputs) != "[1 5]" {
+		t.Errorf("dead letter inputs = %v, want [1 5]", inputs)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	var healthy atomic.Bool
+	half := TryMap(func(i int) (int, error) {
+		if i%2 != 0 && !healthy.Load() {
+			return 0, errOdd
+		}
+		return i / 2, nil
+	})
+	newBuilder := func() *Builder {
+		return NewBuilder().
+			Source("numbers", Values(1, 2, 3, 4)).
+			Stage("half", half, "numbers").
+			Stage("inc", Map(func(i int) int { return i + 1 }), "half")
+	}
+
+	// First run: the odd numbers end up in the dead-letter file
+	var file bytes.Buffer
+	pipeline, err := newBuilder().DeadLetters(NewJSONLinesSink(&file)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(collect(pipeline.Output("inc"))); got != "[2 3]" {
+		t.Fatalf("first run produced %s", got)
+	}
+	pipeline.Wait()
+
+	letters, err := ReadDeadLetters(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || letters[0].Err.Error() != errOdd.Error() {
+		t.Fatalf("dead letters = %+v", letters)
+	}
+
+	// Second run: the cause is fixed, replay the letters through half and inc
+	healthy.Store(true)
+	replay, err := newBuilder().Replay(letters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err = replay.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(collect(pipeline.Output("inc"))); got != "[1 2]" {
+		t.Fatalf("replay produced %s", got)
+	}
+	pipeline.Wait()
+}
+
+func TestReplayUnknownStage(t *testing.T) {
+	b := NewBuilder().Source("numbers", Values(1))
+	if _, err := b.Replay([]DeadLetter{{Stage: "half"}}); err == nil {
+		t.Fatal("replaying into an unknown stage succeeded")
+	}
+	if _, err := b.Replay([]DeadLetter{{Stage: "numbers"}}); err == nil {
+		t.Fatal("replaying into a source succeeded")
+	}
+}
+
+func TestDeadLetterJSON(t *testing.T) {
+	for _, err := range []error{errOdd, nil} {
+		b, jerr := json.Marshal(DeadLetter{Stage: "half", Attempt: 1, Input: 3, Err: err})
+		if jerr != nil {
+			t.Fatal(jerr)
+		}
+		var d DeadLetter
+		if jerr := json.Unmarshal(b, &d); jerr != nil {
+			t.Fatal(jerr)
+		}
+		if fmt.Sprint(d.Err) != fmt.Sprint(err) {
+			t.Errorf("round trip of %v decoded %v", err, d.Err)
+		}
+	}
+}
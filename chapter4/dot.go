@@ -0,0 +1,109 @@
+package chapter4
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Graphviz export
+//
+// WriteDOT renders a running pipeline as a Graphviz graph. Write it to a file while the
+// pipeline runs and render it locally:
+//
+//	dot -Tsvg pipeline.dot > pipeline.svg
+//
+// Stages are boxes. A stage running several workers is drawn as a cluster: values fan out
+// from a point to every worker and fan back in to a second point. Every channel is an edge
+// labelled with its current length, its capacity and its throughput since Start, so a
+// full buffer in front of a stage is easy to spot. Edges that do not block when full also
+// show their overflow policy and how many values they dropped.
+
+// WriteDOT writes the current state of the pipeline to w in the DOT language. It must be
+// called after Start.
+func (p *Pipeline) WriteDOT(w io.Writer) error {
+	var buf bytes.Buffer
+	elapsed := time.Since(p.started).Seconds()
+
+	fmt.Fprintln(&buf, "digraph pipeline {")
+	fmt.Fprintln(&buf, "\trankdir=LR;")
+	fmt.Fprintln(&buf, "\tnode [shape=box];")
+
+	for _, s := range p.order {
+		label := s.Name
+		if s.proc.source != nil {
+			label += "\\n(source)"
+		}
+
+		if s.Workers <= 1 {
+			fmt.Fprintf(&buf, "\t%s [label=%s];\n", dotQuote(s.Name), dotQuote(label))
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\tsubgraph %s {\n", dotQuote("cluster_"+s.Name))
+		fmt.Fprintf(&buf, "\t\tlabel=%s;\n", dotQuote(fmt.Sprintf("%s (%d workers)", s.Name, s.Workers)))
+		fmt.Fprintf(&buf, "\t\t%s [shape=point];\n", dotQuote(fanOutNode(s)))
+		fmt.Fprintf(&buf, "\t\t%s [shape=point];\n", dotQuote(fanInNode(s)))
+		for i := 0; i < s.Workers; i++ {
+			worker := fmt.Sprintf("%s/%d", s.Name, i)
+			fmt.Fprintf(&buf, "\t\t%s [label=%s];\n", dotQuote(worker), dotQuote(worker))
+			fmt.Fprintf(&buf, "\t\t%s -> %s [style=dashed];\n", dotQuote(fanOutNode(s)), dotQuote(worker))
+			fmt.Fprintf(&buf, "\t\t%s -> %s [style=dashed];\n", dotQuote(worker), dotQuote(fanInNode(s)))
+		}
+		fmt.Fprintln(&buf, "\t}")
+	}
+
+	byName := make(map[string]stageDef, len(p.order))
+	for _, s := range p.order {
+		byName[s.Name] = s
+	}
+
+	for _, e := range p.edges {
+		to := "output:" + e.from
+		if e.to == "" {
+			fmt.Fprintf(&buf, "\t%s [shape=plaintext, label=\"output\"];\n", dotQuote(to))
+		} else {
+			to = fanOutNode(byName[e.to])
+		}
+
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(e.Sent()+e.Spilled()) / elapsed
+		}
+		label := fmt.Sprintf("%d/%d\\n%.1f/s", e.Len(), e.Cap(), rate)
+		if e.bp.Policy != Block {
+			label += fmt.Sprintf("\\n%v, %d dropped", e.bp.Policy, e.Dropped())
+		}
+		fmt.Fprintf(&buf, "\t%s -> %s [label=%s];\n",
+			dotQuote(fanInNode(byName[e.from])), dotQuote(to), dotQuote(label))
+	}
+
+	fmt.Fprintln(&buf, "}")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// fanOutNode is the node edges into s point to.
+func fanOutNode(s stageDef) string {
+	if s.Workers <= 1 {
+		return s.Name
+	}
+	return s.Name + ":fan-out"
+}
+
+// fanInNode is the node edges out of s start from.
+func fanInNode(s stageDef) string {
+	if s.Workers <= 1 {
+		return s.Name
+	}
+	return s.Name + ":fan-in"
+}
+
+// dotQuote quotes s as a DOT string. Unlike %q it leaves backslashes alone, so `\n` in a
+// label is rendered as a line break.
+func dotQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,62 @@
+package chapter4
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPipelineDOT(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(fanOutSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := FromSpec(spec, DefaultRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read one value so the graph shows a pipeline in motion, with values waiting in the
+	// buffered channel of double.
+	<-pipeline.Output("merged")
+
+	var buf bytes.Buffer
+	if err := pipeline.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+
+	for _, want := range []string{
+		`digraph pipeline {`,
+		`"numbers" [label="numbers\n(source)"];`,
+		`subgraph "cluster_double" {`,
+		`"double:fan-out" -> "double/2" [style=dashed];`,
+		`"numbers" -> "double:fan-out" [label="`,
+		`"double:fan-in" -> "merged:fan-out" [label="`,
+		`"merged:fan-in" -> "output:merged" [label="`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output is missing %s", want)
+		}
+	}
+	if strings.Count(dot, "/2\\n") < 1 {
+		t.Errorf("no edge shows the capacity of double's buffer")
+	}
+	if t.Failed() {
+		t.Log(dot)
+	}
+
+	for range pipeline.Output("merged") {
+	}
+	pipeline.Wait()
+}
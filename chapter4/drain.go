@@ -0,0 +1,93 @@
+package chapter4
+
+import "time"
+
+// Draining
+//
+// Closing done stops a pipeline right away: every value still in a channel, or in the
+// hands of a stage, is abandoned. That is fine for a test, but a job that stops for a
+// deploy wants to finish what it started. Drain stops in two phases:
+//
+//  1. the sources stop reading new input, everything they already emitted keeps flowing
+//  2. once the last stage closed its outputs the pipeline is done; if that takes longer
+//     than the deadline, the pipeline is cancelled like with Stop
+//
+// The outputs must still be read while draining, otherwise the last stages can never
+// finish. Both Drain and Stop report what happened to the values inside the pipeline.
+
+// DrainReport counts what happened to the values of a stopped pipeline. A value sent to
+// several stages counts once for every stage it was sent to.
+type DrainReport struct {
+	// Completed is the number of values that reached an output.
+	Completed int64
+
+	// Failed is the number of values that became dead letters.
+	Failed int64
+
+	// Dropped is the number of values thrown away by the overflow policy of an edge.
+	Dropped int64
+
+	// Abandoned is the number of values still in the pipeline when it was cancelled.
+	Abandoned int64
+
+	// Graceful reports whether the pipeline drained before the deadline.
+	Graceful bool
+}
+
+// Drain stops the sources and waits up to timeout for the values in flight to reach the
+// outputs, then cancels whatever is left.
+func (p *Pipeline) Drain(timeout time.Duration) DrainReport {
+	p.stopSources()
+
+	finished := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(finished)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-finished:
+		// Every stage has exited, so cancelling only releases the goroutine watching the
+		// parent channel. The spill files of the outputs keep feeding their readers.
+		p.drained.Store(true)
+		p.Cancel()
+		return p.report(true)
+	case <-t.C:
+		p.Cancel()
+		<-finished
+		return p.report(false)
+	}
+}
+
+// Stop cancels the pipeline right away, abandoning the values in flight, and waits for
+// every stage to stop.
+func (p *Pipeline) Stop() DrainReport {
+	p.Cancel()
+	p.Wait()
+	return p.report(false)
+}
+
+func (p *Pipeline) stopSources() {
+	p.stopOnce.Do(func() { close(p.sourceDone) })
+}
+
+func (p *Pipeline) report(graceful bool) DrainReport {
+	r := DrainReport{
+		Completed: p.completed.Load(),
+		Failed:    p.failed.Load(),
+		Abandoned: p.inFlight.Load(),
+		Graceful:  graceful,
+	}
+	for _, e := range p.edges {
+		r.Dropped += e.Dropped()
+		if e.to == "" {
+			r.Completed -= e.Dropped()
+		} else {
+			r.Abandoned -= e.Dropped()
+		}
+	}
+	return r
+}
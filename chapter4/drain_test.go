@@ -0,0 +1,148 @@
+package chapter4
+
+import (
+	"testing"
+	"time"
+)
+
+// counting emits 1, 2, 3, ... until done is closed.
+func counting() Processor {
+	return Source(func(done <-chan interface{}) <-chan int {
+		stream := make(chan int)
+		go func() {
+			defer close(stream)
+			for i := 1; ; i++ {
+				select {
+				case <-done:
+					return
+				case stream <- i:
+				}
+			}
+		}()
+		return stream
+	})
+}
+
+func slowInc(d time.Duration) Processor {
+	return Map(func(i int) int { time.Sleep(d); return i + 1 })
+}
+
+func startDrainPipeline(t *testing.T, d time.Duration) (*Pipeline, chan interface{}) {
+	t.Helper()
+	pipeline, err := NewBuilder().
+		Source("numbers", counting()).
+		Add(StageSpec{Name: "inc", Inputs: []string{"numbers"}, Workers: 2, Buffer: 4}, slowInc(d)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan interface{})
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+	return pipeline, done
+}
+
+func TestPipelineDrain(t *testing.T) {
+	pipeline, done := startDrainPipeline(t, time.Millisecond)
+	defer close(done)
+
+	read := make(chan int)
+	go func() {
+		n := 0
+		for range pipeline.Output("inc") {
+			n++
+		}
+		read <- n
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	report := pipeline.Drain(time.Second)
+	n := <-read
+
+	if !report.Graceful || report.Abandoned != 0 {
+		t.Fatalf("drain was not graceful: %+v", report)
+	}
+	if report.Completed != int64(n) || n == 0 {
+		t.Fatalf("report counts %d completed, the output delivered %d", report.Completed, n)
+	}
+
+	// done is still open, the drained pipeline must not wait for it
+	select {
+	case <-pipeline.done:
+	default:
+		t.Fatal("pipeline still waits for its parent after draining")
+	}
+}
+
+func TestPipelineDrainDeadline(t *testing.T) {
+	pipeline, done := startDrainPipeline(t, 50*time.Millisecond)
+	defer close(done)
+
+	go func() {
+		for range pipeline.Output("inc") {
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	report := pipeline.Drain(10 * time.Millisecond)
+
+	if report.Graceful {
+		t.Fatalf("drain of a slow stage finished before the deadline: %+v", report)
+	}
+	// both workers hold a value when the deadline hits; after the cancel each one races
+	// the output against done, so it either completes or is abandoned
+	if report.Completed+report.Abandoned < 2 {
+		t.Fatalf("values at hand went missing: %+v", report)
+	}
+	// the stage only notices the cancel after the value at hand
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("drain took %v after the deadline", elapsed)
+	}
+}
+
+func TestPipelineStop(t *testing.T) {
+	pipeline, done := startDrainPipeline(t, time.Millisecond)
+	defer close(done)
+
+	// nobody reads the output, so values pile up in the buffers
+	time.Sleep(20 * time.Millisecond)
+	report := pipeline.Stop()
+
+	if report.Graceful {
+		t.Fatalf("Stop reported a graceful drain: %+v", report)
+	}
+	if report.Abandoned == 0 || report.Completed == 0 {
+		t.Fatalf("expected completed and abandoned values: %+v", report)
+	}
+	if report.Failed != 0 || report.Dropped != 0 {
+		t.Fatalf("unexpected failures: %+v", report)
+	}
+}
+
+func TestPipelineDrainSpilledOutput(t *testing.T) {
+	pipeline, err := NewBuilder().
+		Source("numbers", Values(1, 2, 3, 4, 5)).
+		Stage("inc", Map(func(i int) int { return i + 1 }), "numbers").
+		Edge("inc", "", Backpressure{Policy: Spill, SpillDir: t.TempDir(), SpillLimit: 10}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody reads the output, so it is spilled and must still be delivered after the
+	// drain released the pipeline
+	pipeline.Wait()
+	if report := pipeline.Drain(time.Second); !report.Graceful {
+		t.Fatalf("drain was not graceful: %+v", report)
+	}
+	if got := collect(pipeline.Output("inc")); len(got) != 5 {
+		t.Fatalf("output delivered %v after draining, want 5 values", got)
+	}
+}
@@ -0,0 +1,274 @@
+package chapter4
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pipeline metrics
+//
+// A pipeline is only as fast as its slowest stage, but from the outside every stage looks
+// the same: a goroutine sitting between two channels. To find the bottleneck we count what
+// goes in and out of each stage and split its wall time into three parts:
+//
+//   - blocked on receive: the stage is starving, upstream is the slow one
+//   - processing:         the stage itself is doing work
+//   - blocked on send:    downstream is not keeping up (backpressure)
+//
+// Together with the occupancy of the output buffer this is usually enough to tell which
+// stage to scale out.
+
+// histogramBuckets is the number of latency buckets. Bucket i counts observations up to
+// 1µs << i, the last bucket catches everything above that.
+const histogramBuckets = 26
+
+// Histogram is a fixed, exponential bucket latency histogram that is safe for concurrent
+// use. The zero value is ready to use.
+type Histogram struct {
+	buckets [histogramBuckets]atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64
+}
+
+// Observe records one duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < histogramBuckets-1 && d > bucketBound(i) {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Snapshot returns a point in time copy of the histogram. Buckets without observations are
+// left out.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Count: h.count.Load(),
+		Sum:   time.Duration(h.sum.Load()),
+	}
+	for i := range h.buckets {
+		if n := h.buckets[i].Load(); n > 0 {
+			s.Buckets = append(s.Buckets, Bucket{UpperBound: bucketBound(i), Count: n})
+		}
+	}
+	return s
+}
+
+func bucketBound(i int) time.Duration {
+	if i == histogramBuckets-1 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Microsecond << i
+}
+
+// Bucket is a single histogram bucket, Count is the number of observations less than or
+// equal to UpperBound that did not fit in a smaller bucket.
+type Bucket struct {
+	UpperBound time.Duration `json:"le"`
+	Count      int64         `json:"count"`
+}
+
+// HistogramSnapshot is a copy of a Histogram taken at one point in time.
+type HistogramSnapshot struct {
+	Count   int64         `json:"count"`
+	Sum     time.Duration `json:"sum"`
+	Buckets []Bucket      `json:"buckets,omitempty"`
+}
+
+// Mean returns the average observed duration.
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding the q-th quantile (0 <= q <= 1).
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(s.Count))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, b := range s.Buckets {
+		seen += b.Count
+		if seen >= rank {
+			return b.UpperBound
+		}
+	}
+	return s.Buckets[len(s.Buckets)-1].UpperBound
+}
+
+// StageMetrics collects the counters of a single pipeline stage. All methods are safe for
+// concurrent use, so several workers of the same stage may share one StageMetrics.
+type StageMetrics struct {
+	name string
+
+	itemsIn     atomic.Int64
+	itemsOut    atomic.Int64
+	recvBlocked atomic.Int64
+	sendBlocked atomic.Int64
+	latency     Histogram
+
+	bufferMax atomic.Int64
+	mu        sync.Mutex
+	bufferLen func() int
+	bufferCap int
+}
+
+// NewStageMetrics returns an empty StageMetrics for the stage called name.
+func NewStageMetrics(name string) *StageMetrics {
+	return &StageMetrics{name: name}
+}
+
+// Name returns the name of the stage.
+func (m *StageMetrics) Name() string {
+	return m.name
+}
+
+// watchBuffer makes the metrics report the occupancy of the stage's output channel.
+func (m *StageMetrics) watchBuffer(length func() int, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bufferLen = length
+	m.bufferCap = capacity
+}
+
+func (m *StageMetrics) received(blocked time.Duration) {
+	m.itemsIn.Add(1)
+	m.recvBlocked.Add(int64(blocked))
+}
+
+func (m *StageMetrics) processed(took time.Duration) {
+	m.latency.Observe(took)
+}
+
+func (m *StageMetrics) sent(blocked time.Duration, buffered int) {
+	m.itemsOut.Add(1)
+	m.sendBlocked.Add(int64(blocked))
+	for {
+		max := m.bufferMax.Load()
+		if int64(buffered) <= max || m.bufferMax.CompareAndSwap(max, int64(buffered)) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a copy of the stage counters.
+func (m *StageMetrics) Snapshot() StageSnapshot {
+	s := StageSnapshot{
+		Name:        m.name,
+		ItemsIn:     m.itemsIn.Load(),
+		ItemsOut:    m.itemsOut.Load(),
+		RecvBlocked: time.Duration(m.recvBlocked.Load()),
+		SendBlocked: time.Duration(m.sendBlocked.Load()),
+		Latency:     m.latency.Snapshot(),
+		BufferMax:   int(m.bufferMax.Load()),
+	}
+
+	m.mu.Lock()
+	if m.bufferLen != nil {
+		s.BufferLen = m.bufferLen()
+	}
+	s.BufferCap = m.bufferCap
+	m.mu.Unlock()
+
+	return s
+}
+
+// StageSnapshot is a copy of StageMetrics taken at one point in time.
+type StageSnapshot struct {
+	Name        string            `json:"name"`
+	ItemsIn     int64             `json:"items_in"`
+	ItemsOut    int64             `json:"items_out"`
+	RecvBlocked time.Duration     `json:"recv_blocked"`
+	SendBlocked time.Duration     `json:"send_blocked"`
+	Latency     HistogramSnapshot `json:"latency"`
+	BufferLen   int               `json:"buffer_len"`
+	BufferCap   int               `json:"buffer_cap"`
+	BufferMax   int               `json:"buffer_max"`
+}
+
+// PipelineMetrics groups the StageMetrics of one pipeline. It implements expvar.Var, so
+// it can be published and read from /debug/vars.
+type PipelineMetrics struct {
+	mu     sync.Mutex
+	stages map[string]*StageMetrics
+}
+
+// NewPipelineMetrics returns an empty PipelineMetrics.
+func NewPipelineMetrics() *PipelineMetrics {
+	return &PipelineMetrics{stages: make(map[string]*StageMetrics)}
+}
+
+// Stage returns the metrics of the stage called name, creating them on first use.
+func (p *PipelineMetrics) Stage(name string) *StageMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.stages[name]
+	if !ok {
+		m = NewStageMetrics(name)
+		p.stages[name] = m
+	}
+	return m
+}
+
+// Snapshot returns a copy of every stage's counters, sorted by stage name.
+func (p *PipelineMetrics) Snapshot() []StageSnapshot {
+	p.mu.Lock()
+	stages := make([]*StageMetrics, 0, len(p.stages))
+	for _, m := range p.stages {
+		stages = append(stages, m)
+	}
+	p.mu.Unlock()
+
+	snapshots := make([]StageSnapshot, 0, len(stages))
+	for _, m := range stages {
+		snapshots = append(snapshots, m.Snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots
+}
+
+// String returns the snapshot as JSON, as required by expvar.Var.
+func (p *PipelineMetrics) String() string {
+	b, err := json.Marshal(p.Snapshot())
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// ErrMetricsPublished is returned by Publish when the expvar name is already taken.
+var ErrMetricsPublished = errors.New("chapter4: expvar name already published")
+
+// publishMu serializes Publish, so two callers cannot both find a name free.
+var publishMu sync.Mutex
+
+// Publish registers the pipeline metrics with expvar under name. Unlike expvar.Publish it
+// returns an error instead of panicking when name is already in use. That only holds
+// against other callers of Publish: code calling expvar.Publish directly with the same
+// name at the same time can still make one of them panic.
+func (p *PipelineMetrics) Publish(name string) error {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	if expvar.Get(name) != nil {
+		return ErrMetricsPublished
+	}
+	expvar.Publish(name, p)
+	return nil
+}
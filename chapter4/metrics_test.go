@@ -0,0 +1,117 @@
+package chapter4
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStageMetrics(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	metrics := NewPipelineMetrics()
+	stage := func(name string, in <-chan int, fn func(int) int) <-chan int {
+		return MapStage(done, in, fn, StageOptions{Buffer: 2, Metrics: metrics.Stage(name)})
+	}
+
+	// Same shape as TestPipelineV1, but every stage is instrumented and the last
+	// multiply is made deliberately slow so it shows up as the bottleneck.
+	intStream := Generator(done, 1, 2, 3, 4)
+	pipeline := stage("3-multiply", stage("2-add", stage("1-multiply", intStream,
+		func(i int) int { return i * 2 }),
+		func(i int) int { return i + 1 }),
+		func(i int) int { time.Sleep(5 * time.Millisecond); return i * 2 })
+
+	var got []int
+	for v := range pipeline {
+		got = append(got, v)
+	}
+	if fmt.Sprint(got) != "[6 10 14 18]" {
+		t.Fatalf("pipeline produced %v", got)
+	}
+
+	snapshots := metrics.Snapshot()
+	if len(snapshots) != 3 {
+		t.Fatalf("got %d stages, want 3", len(snapshots))
+	}
+	for _, s := range snapshots {
+		if s.ItemsIn != 4 || s.ItemsOut != 4 {
+			t.Errorf("%s: in=%d out=%d, want 4/4", s.Name, s.ItemsIn, s.ItemsOut)
+		}
+		if s.Latency.Count != 4 {
+			t.Errorf("%s: latency count %d, want 4", s.Name, s.Latency.Count)
+		}
+		if s.BufferCap != 2 {
+			t.Errorf("%s: buffer cap %d, want 2", s.Name, s.BufferCap)
+		}
+		fmt.Printf("%-10s p50=%-8v recv-blocked=%-12v send-blocked=%v\n",
+			s.Name, s.Latency.Quantile(0.5), s.RecvBlocked, s.SendBlocked)
+	}
+
+	slow := metrics.Stage("3-multiply").Snapshot()
+	if slow.Latency.Quantile(0.5) < 5*time.Millisecond {
+		t.Errorf("slow stage p50 = %v, want >= 5ms", slow.Latency.Quantile(0.5))
+	}
+}
+
+func TestPipelineMetricsExpvar(t *testing.T) {
+	metrics := NewPipelineMetrics()
+	metrics.Stage("multiply").received(time.Millisecond)
+
+	// expvar names live for the whole process, keep them unique across -count runs
+	name := fmt.Sprintf("chapter4.%s.%d", t.Name(), time.Now().UnixNano())
+	if err := metrics.Publish(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := metrics.Publish(name); err != ErrMetricsPublished {
+		t.Fatalf("second Publish returned %v, want ErrMetricsPublished", err)
+	}
+
+	var stages []StageSnapshot
+	v := expvar.Get(name)
+	if err := json.Unmarshal([]byte(v.String()), &stages); err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != 1 || stages[0].Name != "multiply" || stages[0].ItemsIn != 1 {
+		t.Fatalf("unexpected expvar content: %s", v.String())
+	}
+
+	// concurrent callers with the same name: one wins, the others get the error
+	name += ".concurrent"
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- NewPipelineMetrics().Publish(name) }()
+	}
+	published := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			published++
+		} else if err != ErrMetricsPublished {
+			t.Fatal(err)
+		}
+	}
+	if published != 1 {
+		t.Fatalf("%d concurrent Publish calls succeeded, want 1", published)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h Histogram
+	for i := 0; i < 90; i++ {
+		h.Observe(time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(time.Second)
+	}
+
+	s := h.Snapshot()
+	if s.Quantile(0.5) != time.Microsecond {
+		t.Errorf("p50 = %v, want 1µs", s.Quantile(0.5))
+	}
+	if s.Quantile(0.99) < time.Second {
+		t.Errorf("p99 = %v, want >= 1s", s.Quantile(0.99))
+	}
+}
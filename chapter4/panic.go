@@ -0,0 +1,96 @@
+package chapter4
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// Panic isolation
+//
+// A panic in a goroutine cannot be recovered by anyone but that goroutine, so a panic
+// inside a stage function takes the whole process down, test binary included. TryStage
+// recovers panics of the stage function and turns them into a *PanicError, which carries
+// the stack trace of the panic and is handled like any other failure: the input becomes a
+// dead letter. A panic usually means a bug rather than a bad input, so it is not retried.
+//
+// The other stages recover too. ResultStage and ContextStage send the *PanicError on as
+// the error of a StageResult, MapStage, and TracedStage on top of it, drop the value and
+// hand the *PanicError to StageOptions.OnPanic.
+//
+// What happens to the stage afterwards is decided per pipeline by a PanicPolicy:
+//
+//   - SkipItem:      the stage goes on with the next input
+//   - RestartStage:  the worker that panicked gets a fresh stage function (see Stateful)
+//   - AbortPipeline: the whole pipeline is cancelled and Pipeline.Err reports the panic
+
+// PanicError is a panic recovered from a stage function.
+type PanicError struct {
+	Stage string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("chapter4: stage %q panicked: %v", e.Stage, e.Value)
+}
+
+// PanicPolicy decides what a pipeline does after a stage function panicked.
+type PanicPolicy int
+
+const (
+	SkipItem PanicPolicy = iota
+	RestartStage
+	AbortPipeline
+)
+
+var panicPolicyNames = []string{"skip-item", "restart-stage", "abort-pipeline"}
+
+func (p PanicPolicy) String() string {
+	if p < 0 || int(p) >= len(panicPolicyNames) {
+		return fmt.Sprintf("PanicPolicy(%d)", int(p))
+	}
+	return panicPolicyNames[p]
+}
+
+// MarshalText encodes the policy by name, e.g. "restart-stage".
+func (p PanicPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes a policy name.
+func (p *PanicPolicy) UnmarshalText(text []byte) error {
+	for i, name := range panicPolicyNames {
+		if name == string(text) {
+			*p = PanicPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("chapter4: unknown panic policy %q", text)
+}
+
+// protect calls fn and turns a panic into a *PanicError.
+func protect[T, U any](stage string, fn func(T) (U, error), v T) (result U, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Stage: stage, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn(v)
+}
+
+// callStage calls the fn of mapStage. A panic of fn drops the value and is reported to
+// opts.OnPanic, or logged without it.
+func callStage[T, U any](opts StageOptions, fn func(T) (U, bool), v T) (result U, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := &PanicError{Stage: opts.Name, Value: r, Stack: debug.Stack()}
+			if opts.OnPanic == nil {
+				log.Printf("%v\n%s", err, err.Stack)
+				return
+			}
+			opts.OnPanic(err)
+		}
+	}()
+	return fn(v)
+}
@@ -0,0 +1,222 @@
+package chapter4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTryStageRecoversPanic(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	var calls int
+	explode := func(i int) (int, error) {
+		calls++
+		if i == 2 {
+			var m map[string]int
+			m["boom"] = i // assignment to entry in nil map
+		}
+		return i, nil
+	}
+
+	letters := make(chan DeadLetter, 1)
+	var got []int
+	for v := range TryStage(done, Generator(done, 1, 2, 3), explode,
+		DeadLetterOptions{Stage: "explode", Attempts: 3, Sink: ChanSink(letters)}, StageOptions{}) {
+		got = append(got, v)
+	}
+
+	if fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("results = %v, want [1 3]", got)
+	}
+	if calls != 3 {
+		t.Errorf("stage function called %d times, a panic must not be retried", calls)
+	}
+
+	d := <-letters
+	var pe *PanicError
+	if !errors.As(d.Err, &pe) {
+		t.Fatalf("dead letter error %v is not a *PanicError", d.Err)
+	}
+	if pe.Stage != "explode" || d.Input != 2 || d.Attempt != 1 {
+		t.Errorf("unexpected dead letter %+v", d)
+	}
+	if !strings.Contains(string(pe.Stack), "TestTryStageRecoversPanic") {
+		t.Errorf("stack trace does not point at the stage function:\n%s", pe.Stack)
+	}
+}
+
+// counter numbers its inputs, and panics on the input 3
+func counter() func(int) (string, error) {
+	var seen int
+	return func(i int) (string, error) {
+		if i == 3 {
+			panic("three")
+		}
+		seen++
+		return fmt.Sprintf("%d:%d", seen, i), nil
+	}
+}
+
+func TestPanicPolicies(t *testing.T) {
+	tests := []struct {
+		policy PanicPolicy
+		want   string
+	}{
+		{policy: SkipItem, want: "[1:1 2:2 3:4 4:5]"},
+		{policy: RestartStage, want: "[1:1 2:2 1:4 2:5]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			pipeline, err := NewBuilder().
+				Source("numbers", Values(1, 2, 3, 4, 5)).
+				Stage("count", Stateful(counter), "numbers").
+				OnPanic(tt.policy).
+				DeadLetters(FuncSink(func(DeadLetter) error { return nil })).
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan interface{})
+			defer close(done)
+			if err := pipeline.Start(done); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for v := range pipeline.Output("count") {
+				got = append(got, v.(string))
+			}
+			pipeline.Wait()
+
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("outputs = %v, want %s", got, tt.want)
+			}
+			if pipeline.Err() != nil {
+				t.Errorf("Err() = %v, want nil", pipeline.Err())
+			}
+			if restarts := pipeline.Restarts("count"); (tt.policy == RestartStage) != (restarts == 1) {
+				t.Errorf("%d restarts with policy %v", restarts, tt.policy)
+			}
+		})
+	}
+}
+
+func TestPanicAbortsPipeline(t *testing.T) {
+	spec := Spec{OnPanic: AbortPipeline}
+	b, err := FromSpec(spec, DefaultRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := b.
+		Source("numbers", Values(1, 2, 3, 4, 5)).
+		Stage("count", Stateful(counter), "numbers").
+		DeadLetters(FuncSink(func(DeadLetter) error { return nil })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for v := range pipeline.Output("count") {
+		got = append(got, v.(string))
+	}
+	pipeline.Wait()
+
+	// values still in flight when the pipeline is cancelled may be lost, but nothing
+	// after the panic gets through
+	for _, v := range got {
+		if v != "1:1" && v != "2:2" {
+			t.Errorf("outputs = %v, nothing after the panic should come through", got)
+		}
+	}
+	var pe *PanicError
+	if !errors.As(pipeline.Err(), &pe) || pe.Value != "three" {
+		t.Fatalf("Err() = %v, want the panic of stage count", pipeline.Err())
+	}
+}
+
+func TestMapStageRecoversPanic(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	half := func(i int) int {
+		if i%2 != 0 {
+			panic(fmt.Sprintf("%d is odd", i))
+		}
+		return i / 2
+	}
+
+	var panics []*PanicError
+	var got []int
+	for v := range MapStage(done, Generator(done, 2, 3, 4), half,
+		StageOptions{Name: "half", OnPanic: func(pe *PanicError) { panics = append(panics, pe) }}) {
+		got = append(got, v)
+	}
+	if fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("MapStage results = %v, want [1 2]", got)
+	}
+	if len(panics) != 1 || panics[0].Stage != "half" || panics[0].Value != "3 is odd" {
+		t.Fatalf("OnPanic got %v", panics)
+	}
+	if !strings.Contains(string(panics[0].Stack), "TestMapStageRecoversPanic") {
+		t.Errorf("stack trace does not point at the stage function:\n%s", panics[0].Stack)
+	}
+
+	// ResultStage sends the panic on as the error of the value
+	var results []string
+	for r := range ResultStage(done, Generator(done, 2, 3, 4), half, StageOptions{Name: "half"}) {
+		var pe *PanicError
+		switch {
+		case errors.As(r.Error, &pe):
+			results = append(results, fmt.Sprintf("panic %v", pe.Value))
+		case r.Error != nil:
+			t.Fatalf("unexpected error %v", r.Error)
+		default:
+			results = append(results, fmt.Sprint(r.Value))
+		}
+	}
+	if fmt.Sprint(results) != "[1 panic 3 is odd 2]" {
+		t.Errorf("ResultStage results = %v", results)
+	}
+}
+
+func TestContextStageRecoversPanic(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	half := func(_ context.Context, i int) (int, error) {
+		if i%2 != 0 {
+			panic("odd")
+		}
+		return i / 2, nil
+	}
+
+	// with an ItemTimeout the call runs on a goroutine of its own
+	for _, opts := range []StageOptions{{Name: "half"}, {Name: "half", ItemTimeout: time.Second}} {
+		var got []string
+		for r := range ContextStage(done, Generator(done, 2, 3, 4), half, opts) {
+			var pe *PanicError
+			if errors.As(r.Error, &pe) && pe.Stage == "half" {
+				got = append(got, "panic")
+				continue
+			}
+			got = append(got, fmt.Sprint(r.Value, r.Error))
+		}
+		if fmt.Sprint(got) != "[1 <nil> panic 2 <nil>]" {
+			t.Errorf("timeout %v: results = %v", opts.ItemTimeout, got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package chapter4
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// StageOptions configures a stage started by MapStage. The zero value gives the same
+// behaviour as the hand-written stages in 5_pipeline_test.go: an unbuffered output
+// channel and no instrumentation.
+type StageOptions struct {
+	// Buffer is the capacity of the stage's output channel.
+	Buffer int
+
+	// Metrics, when set, receives the stage counters. Leaving it nil skips every
+	// time.Now call, so an uninstrumented stage costs nothing extra.
+	Metrics *StageMetrics
+
+	// ItemTimeout, when positive, is how long ContextStage gives fn for a single value.
+	ItemTimeout time.Duration
+
+	// Name is the stage name recorded in a *PanicError.
+	Name string
+
+	// OnPanic, when set, is called with the *PanicError of a value for which fn panicked,
+	// on the goroutine of the stage. Without it the panic is logged. Either way the value
+	// is not sent on.
+	OnPanic func(*PanicError)
+}
+
+// MapStage is the generic form of Multiply and Add: it applies fn to every value read from
+// in and writes the result to the returned channel, until in is closed or done is. A value
+// for which fn panics is dropped and reported to opts.OnPanic; use ResultStage to receive
+// it as an error result instead.
+func MapStage[T, U any](
+	done <-chan interface{},
+	in <-chan T,
+	fn func(T) U,
+	opts StageOptions,
+) <-chan U {
+	return mapStage(done, in, func(v T) (U, bool) { return fn(v), true }, opts)
+}
+
+// mapStage runs the loop behind MapStage. Values for which fn returns false are not sent
+// on, which lets the stages built on top of it divert values elsewhere.
+func mapStage[T, U any](
+	done <-chan interface{},
+	in <-chan T,
+	fn func(T) (U, bool),
+	opts StageOptions,
+) <-chan U {
+	out := make(chan U, opts.Buffer)
+
+	m := opts.Metrics
+	if m != nil {
+		m.watchBuffer(func() int { return len(out) }, cap(out))
+	}
+
+	go func() {
+		defer close(out)
+
+		for {
+			var start time.Time
+			if m != nil {
+				start = time.Now()
+			}
+
+			var v T
+			var ok bool
+			select {
+			case <-done:
+				return
+			case v, ok = <-in:
+			}
+			if !ok {
+				return
+			}
+
+			if m != nil {
+				now := time.Now()
+				m.received(now.Sub(start))
+				start = now
+			}
+
+			result, ok := callStage(opts, fn, v)
+
+			if m != nil {
+				now := time.Now()
+				m.processed(now.Sub(start))
+				start = now
+			}
+			if !ok {
+				continue
+			}
+
+			select {
+			case <-done:
+				return
+			case out <- result:
+			}
+
+			if m != nil {
+				m.sent(time.Since(start), len(out))
+			}
+		}
+	}()
+
+	return out
+}
+
+// ErrItemTimeout is the error of a value that ContextStage gave up on.
+var ErrItemTimeout = errors.New("chapter4: item timed out")
+
+// StageResult is a value or the error that replaced it, like Result in
+// 4_error_handling_test.go.
+type StageResult[T any] struct {
+	Value T
+	Error error
+}
+
+// ResultStage is MapStage that sends every value on as a StageResult. A value for which fn
+// panicked arrives as a StageResult whose Error is the *PanicError.
+func ResultStage[T, U any](
+	done <-chan interface{},
+	in <-chan T,
+	fn func(T) U,
+	opts StageOptions,
+) <-chan StageResult[U] {
+	call := func(v T) (U, error) { return fn(v), nil }
+	return mapStage(done, in, func(v T) (StageResult[U], bool) {
+		result, err := protect(opts.Name, call, v)
+		return StageResult[U]{Value: result, Error: err}, true
+	}, opts)
+}
+
+// ContextStage is MapStage for functions that take a context. The context is cancelled
+// when done is closed and, with opts.ItemTimeout set, when the value took too long. A value
+// that timed out is sent on as a StageResult with ErrItemTimeout, and the stage moves on to
+// the next value without waiting for fn. A value for which fn panicked is sent on with the
+// *PanicError.
+//
+// fn keeps running after a timeout until it notices the cancelled context. The output is
+// only closed once every such call returned, so no goroutine outlives the stage.
+func ContextStage[T, U any](
+	done <-chan interface{},
+	in <-chan T,
+	fn func(context.Context, T) (U, error),
+	opts StageOptions,
+) <-chan StageResult[U] {
+	ctx, cancel := context.WithCancel(context.Background())
+	var abandoned sync.WaitGroup
+	call := func(ctx context.Context, v T) StageResult[U] {
+		result, err := protect(opts.Name, func(v T) (U, error) { return fn(ctx, v) }, v)
+		return StageResult[U]{Value: result, Error: err}
+	}
+
+	stream := mapStage(done, in, func(v T) (StageResult[U], bool) {
+		if opts.ItemTimeout <= 0 {
+			return call(ctx, v), true
+		}
+
+		itemCtx, itemCancel := context.WithTimeout(ctx, opts.ItemTimeout)
+		defer itemCancel()
+
+		// buffered, so the call can always hand over its result and return
+		results := make(chan StageResult[U], 1)
+		abandoned.Add(1)
+		go func() {
+			defer abandoned.Done()
+			results <- call(itemCtx, v)
+		}()
+
+		select {
+		case r := <-results:
+			return r, true
+		case <-itemCtx.Done():
+			return StageResult[U]{Error: ErrItemTimeout}, true
+		}
+	}, opts)
+
+	out := make(chan StageResult[U])
+	go func() {
+		defer func() {
+			cancel()
+			for range stream {
+			}
+			abandoned.Wait()
+			close(out)
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			case r, ok := <-stream:
+				if !ok {
+					return
+				}
+				select {
+				case <-done:
+					return
+				case out <- r:
+				}
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,75 @@
+package chapter4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestContextStageTimeout(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	// 2 hangs until it is cancelled, like a checkStatus call to a host that never answers
+	var cancelled, returned atomic.Int32
+	check := func(ctx context.Context, i int) (string, error) {
+		defer returned.Add(1)
+		if i == 2 {
+			<-ctx.Done()
+			cancelled.Add(1)
+			return "", ctx.Err()
+		}
+		return fmt.Sprintf("ok %d", i), nil
+	}
+
+	start := time.Now()
+	results := ContextStage(done, Generator(done, 1, 2, 3), check,
+		StageOptions{ItemTimeout: 20 * time.Millisecond})
+
+	var got []string
+	for r := range results {
+		if r.Error != nil {
+			if !errors.Is(r.Error, ErrItemTimeout) {
+				t.Errorf("unexpected error %v", r.Error)
+			}
+			got = append(got, "timeout")
+			continue
+		}
+		got = append(got, r.Value)
+	}
+
+	if fmt.Sprint(got) != "[ok 1 timeout ok 3]" {
+		t.Fatalf("results = %v", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stage took %v, the slow item was not abandoned", elapsed)
+	}
+	// the output is closed only after the abandoned call returned
+	if cancelled.Load() != 1 || returned.Load() != 3 {
+		t.Fatalf("cancelled=%d returned=%d, want 1 and 3", cancelled.Load(), returned.Load())
+	}
+}
+
+func TestContextStageDone(t *testing.T) {
+	done := make(chan interface{})
+	in := make(chan int, 1)
+	in <- 1
+
+	var cancelled atomic.Bool
+	results := ContextStage(done, in, func(ctx context.Context, i int) (int, error) {
+		<-ctx.Done()
+		cancelled.Store(true)
+		return 0, ctx.Err()
+	}, StageOptions{})
+
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	for range results {
+	}
+	if !cancelled.Load() {
+		t.Fatal("closing done did not cancel the running call")
+	}
+}
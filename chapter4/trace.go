@@ -0,0 +1,237 @@
+package chapter4
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tracing
+//
+// Stage metrics tell us which stage is slow on average, a trace tells us where the time of
+// one particular item went. Every item leaving a traced source gets a TraceID, and every
+// traced stage it passes through records a span with three timestamps:
+//
+//   - Enqueued: the previous stage was done with the item and started sending it to the
+//     stage's input channel
+//   - Start:    the stage received it and started processing
+//   - End:      the stage finished processing
+//
+// Start - Enqueued is the time the item waited for the stage, in a channel buffer or in a
+// send of the previous stage that blocked because the stage was busy. End - Start is the
+// time the stage spent on it.
+
+// TraceID identifies a single item across every stage of a pipeline.
+type TraceID uint64
+
+// NewTraceID returns a random TraceID.
+func NewTraceID() TraceID {
+	return TraceID(rand.Uint64())
+}
+
+func (id TraceID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// MarshalText encodes the ID as 16 hex digits.
+func (id TraceID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes an ID produced by MarshalText.
+func (id *TraceID) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 16, 64)
+	if err != nil {
+		return fmt.Errorf("chapter4: invalid trace id %q: %w", text, err)
+	}
+	*id = TraceID(v)
+	return nil
+}
+
+// Span records one stage's handling of one item.
+type Span struct {
+	Trace    TraceID   `json:"trace_id"`
+	Stage    string    `json:"stage"`
+	Enqueued time.Time `json:"enqueued"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// Queued returns how long the item waited before the stage picked it up.
+func (s Span) Queued() time.Duration {
+	return s.Start.Sub(s.Enqueued)
+}
+
+// Duration returns how long the stage spent processing the item.
+func (s Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Exporter receives finished spans. Export is called from the stage goroutines, so
+// implementations must be safe for concurrent use.
+type Exporter interface {
+	Export(Span) error
+}
+
+// Traced carries a value through a traced pipeline together with its trace context.
+type Traced[T any] struct {
+	Value    T
+	Trace    TraceID
+	Enqueued time.Time
+}
+
+// Tracer hands out trace IDs and forwards spans to an Exporter.
+type Tracer struct {
+	exporter Exporter
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewTracer returns a Tracer exporting to e.
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{exporter: e}
+}
+
+func (t *Tracer) export(s Span) {
+	if err := t.exporter.Export(s); err != nil {
+		t.mu.Lock()
+		if t.err == nil {
+			t.err = err
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Err returns the first error returned by the exporter, if any. A failing exporter never
+// stops the pipeline, the spans are simply lost.
+func (t *Tracer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// TraceSource starts a trace for every value read from in.
+func TraceSource[T any](done <-chan interface{}, in <-chan T) <-chan Traced[T] {
+	out := make(chan Traced[T])
+
+	go func() {
+		defer close(out)
+
+		for v := range in {
+			item := Traced[T]{Value: v, Trace: NewTraceID(), Enqueued: time.Now()}
+			select {
+			case <-done:
+				return
+			case out <- item:
+			}
+		}
+	}()
+
+	return out
+}
+
+// TracedStage is MapStage for traced items: it applies fn to each value, exports a span
+// named name for it and passes the trace on to the next stage.
+func TracedStage[T, U any](
+	done <-chan interface{},
+	tracer *Tracer,
+	name string,
+	in <-chan Traced[T],
+	fn func(T) U,
+	opts StageOptions,
+) <-chan Traced[U] {
+	if opts.Name == "" {
+		opts.Name = name
+	}
+	return MapStage(done, in, func(item Traced[T]) Traced[U] {
+		span := Span{Trace: item.Trace, Stage: name, Enqueued: item.Enqueued, Start: time.Now()}
+		result := fn(item.Value)
+		span.End = time.Now()
+		tracer.export(span)
+
+		// stamped after the export, which can be slow, so only the send is left
+		return Traced[U]{Value: result, Trace: item.Trace, Enqueued: time.Now()}
+	}, opts)
+}
+
+// MemoryExporter keeps every span in memory. It is meant for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// Export implements Exporter.
+func (e *MemoryExporter) Export(s Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+	return nil
+}
+
+// Spans returns a copy of every span exported so far.
+func (e *MemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// Trace returns the spans of one trace in the order they were exported, which is the
+// order of the stages the item went through.
+func (e *MemoryExporter) Trace(id TraceID) []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var spans []Span
+	for _, s := range e.spans {
+		if s.Trace == id {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// JSONLinesExporter writes every span as one JSON object per line.
+type JSONLinesExporter struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewJSONLinesExporter returns an exporter writing to w.
+func NewJSONLinesExporter(w io.Writer) *JSONLinesExporter {
+	return &JSONLinesExporter{enc: json.NewEncoder(w)}
+}
+
+// CreateJSONLinesExporter creates (or truncates) the file at path and returns an exporter
+// writing to it. The file is closed by Close.
+func CreateJSONLinesExporter(path string) (*JSONLinesExporter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONLinesExporter(f)
+	e.closer = f
+	return e, nil
+}
+
+// Export implements Exporter.
+func (e *JSONLinesExporter) Export(s Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(s)
+}
+
+// Close closes the underlying file if the exporter was created by
+// CreateJSONLinesExporter.
+func (e *JSONLinesExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
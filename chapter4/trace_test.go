@@ -0,0 +1,102 @@
+package chapter4
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTracedPipeline(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	exporter := &MemoryExporter{}
+	tracer := NewTracer(exporter)
+
+	multiply := func(i int) int { return i * 2 }
+	add := func(i int) int { time.Sleep(2 * time.Millisecond); return i + 1 }
+
+	intStream := TraceSource(done, Generator(done, 1, 2, 3, 4))
+	pipeline := TracedStage(done, tracer, "multiply", TracedStage(done, tracer, "add",
+		TracedStage(done, tracer, "multiply", intStream, multiply, StageOptions{}),
+		add, StageOptions{}),
+		multiply, StageOptions{})
+
+	var items []Traced[int]
+	for item := range pipeline {
+		items = append(items, item)
+	}
+	if len(items) != 4 {
+		t.Fatalf("got %d items, want 4", len(items))
+	}
+
+	for _, item := range items {
+		spans := exporter.Trace(item.Trace)
+		if len(spans) != 3 {
+			t.Fatalf("trace %v has %d spans, want 3", item.Trace, len(spans))
+		}
+		for i, want := range []string{"multiply", "add", "multiply"} {
+			if spans[i].Stage != want {
+				t.Errorf("span %d is %q, want %q", i, spans[i].Stage, want)
+			}
+		}
+		for i := 1; i < len(spans); i++ {
+			if spans[i].Enqueued.Before(spans[i-1].End) {
+				t.Errorf("span %d enqueued at %v, previous ended at %v", i, spans[i].Enqueued, spans[i-1].End)
+			}
+			if spans[i].Queued() < 0 {
+				t.Errorf("span %d has negative queue time", i)
+			}
+		}
+		if spans[1].Duration() < 2*time.Millisecond {
+			t.Errorf("add took %v, want >= 2ms", spans[1].Duration())
+		}
+	}
+	if err := tracer.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONLinesExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := CreateJSONLinesExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+
+	tracer := NewTracer(exporter)
+	in := TraceSource(done, Generator(done, 1, 2))
+	for range TracedStage(done, tracer, "add", in, func(i int) int { return i + 1 }, StageOptions{}) {
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s Span
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Stage != "add" || s.Trace == 0 {
+			t.Errorf("unexpected span %+v", s)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("got %d lines, want 2", lines)
+	}
+}
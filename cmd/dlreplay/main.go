@@ -0,0 +1,129 @@
+// Command dlreplay replays dead letters into a pipeline described by a JSON spec.
+//
+//	dlreplay -spec pipeline.json -letters dead.jsonl [-dead-letters retry.jsonl]
+//
+// Every letter is fed into the stage it came from, and the values reaching the outputs of
+// the pipeline are printed to stdout as JSON lines. Letters failing again are appended to
+// the -dead-letters file, or logged when it is not set.
+//
+// Stages are created from registry, which only knows the stages of chapter4's default
+// registry. Those never fail, so to replay the letters of a real pipeline, build the
+// command with a file of your own in this package that adds the kinds of its stages:
+//
+//	func init() {
+//		registry["parse"] = func(params json.RawMessage) (chapter4.Processor, error) {
+//			return chapter4.TryMap(parse), nil
+//		}
+//	}
+//
+// Programs that build their pipelines in code can call Builder.Replay directly instead.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ndarayudha/concurrency-in-go/chapter4"
+)
+
+// registry creates the stages of the spec. init functions of other files in this package
+// may add kinds to it.
+var registry = chapter4.DefaultRegistry()
+
+func main() {
+	specPath := flag.String("spec", "", "pipeline spec (JSON)")
+	lettersPath := flag.String("letters", "", "dead letters to replay (JSON lines)")
+	deadLetters := flag.String("dead-letters", "", "file to append letters failing again to")
+	flag.Parse()
+
+	if *specPath == "" || *lettersPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	spec, err := os.Open(*specPath)
+	if err != nil {
+		log.Fatalf("cannot open spec: %v", err)
+	}
+	defer spec.Close()
+	letters, err := os.Open(*lettersPath)
+	if err != nil {
+		log.Fatalf("cannot open dead letters: %v", err)
+	}
+	defer letters.Close()
+
+	var sink chapter4.DeadLetterSink
+	if *deadLetters != "" {
+		s, err := chapter4.OpenJSONLinesSink(*deadLetters)
+		if err != nil {
+			log.Fatalf("cannot open dead letter sink: %v", err)
+		}
+		defer s.Close()
+		sink = s
+	}
+
+	if err := replay(registry, spec, letters, sink, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// replay feeds the letters into the pipeline of spec, with stages created by reg, and
+// writes the values reaching its outputs to w. A nil sink logs letters failing again.
+func replay(reg chapter4.Registry, spec, letters io.Reader, sink chapter4.DeadLetterSink, w io.Writer) error {
+	s, err := chapter4.ParseSpec(spec)
+	if err != nil {
+		return err
+	}
+	b, err := chapter4.FromSpec(s, reg)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		b.DeadLetters(sink)
+	}
+
+	dl, err := chapter4.ReadDeadLetters(letters)
+	if err != nil {
+		return fmt.Errorf("cannot read dead letters: %w", err)
+	}
+	r, err := b.Replay(dl)
+	if err != nil {
+		return fmt.Errorf("cannot replay: %w", err)
+	}
+	pipeline, err := r.Build()
+	if err != nil {
+		return fmt.Errorf("invalid pipeline: %w", err)
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		return fmt.Errorf("cannot start pipeline: %w", err)
+	}
+
+	type output struct {
+		Stage string      `json:"stage"`
+		Value interface{} `json:"value"`
+	}
+
+	var outputs []<-chan output
+	for _, name := range pipeline.Outputs() {
+		name := name
+		outputs = append(outputs, chapter4.MapStage(done, pipeline.Output(name), func(v interface{}) output {
+			return output{Stage: name, Value: v}
+		}, chapter4.StageOptions{}))
+	}
+
+	enc := json.NewEncoder(w)
+	for out := range chapter4.FanIn(done, outputs...) {
+		if err := enc.Encode(out); err != nil {
+			return fmt.Errorf("cannot write output: %w", err)
+		}
+	}
+	pipeline.Wait()
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ndarayudha/concurrency-in-go/chapter4"
+)
+
+const spec = `{"stages": [
+	{"name": "numbers", "kind": "generator", "params": {"values": [1, 2, 3, 4]}},
+	{"name": "half", "kind": "half", "inputs": ["numbers"]},
+	{"name": "inc", "kind": "add", "params": {"n": 1}, "inputs": ["half"]}
+]}`
+
+func TestReplay(t *testing.T) {
+	// half fails on odd numbers until the bug is fixed
+	var fixed atomic.Bool
+	reg := chapter4.DefaultRegistry()
+	reg["half"] = func(json.RawMessage) (chapter4.Processor, error) {
+		return chapter4.TryMap(func(i int) (int, error) {
+			if i%2 != 0 && !fixed.Load() {
+				return 0, errors.New("odd")
+			}
+			return i / 2, nil
+		}), nil
+	}
+
+	// the original run, whose dead letters are written like a real pipeline writes them
+	s, err := chapter4.ParseSpec(strings.NewReader(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := chapter4.FromSpec(s, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letters bytes.Buffer
+	pipeline, err := b.DeadLetters(chapter4.NewJSONLinesSink(&letters)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan interface{})
+	defer close(done)
+	if err := pipeline.Start(done); err != nil {
+		t.Fatal(err)
+	}
+	for range pipeline.Output("inc") {
+	}
+	pipeline.Wait()
+	if n := strings.Count(letters.String(), "\n"); n != 2 {
+		t.Fatalf("%d dead letters, want 2:\n%s", n, letters.String())
+	}
+
+	fixed.Store(true)
+	var again, out bytes.Buffer
+	if err := replay(reg, strings.NewReader(spec), &letters, chapter4.NewJSONLinesSink(&again), &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != `{"stage":"inc","value":1}`+"\n"+`{"stage":"inc","value":2}`+"\n" {
+		t.Errorf("replay output:\n%s", got)
+	}
+	if again.Len() != 0 {
+		t.Errorf("letters failed again:\n%s", again.String())
+	}
+
+	// the default registry cannot create the stage the letters came from
+	if err := replay(chapter4.DefaultRegistry(), strings.NewReader(spec), &letters, nil, &out); err == nil {
+		t.Error("replay without the half stage succeeded")
+	}
+}
@@ -0,0 +1,243 @@
+// Command loadgen measures the latency of the network daemon from chapter3 under load.
+//
+//	loadgen [-addr host:port] [-mode warm|cold|both] [-c 16] [-rate 0] [-d 10s]
+//
+// Every request dials the daemon and reads until it hangs up, like BenchmarkNetworkRequest
+// does. With -rate 0 the generator runs closed-loop: each of the -c workers sends its next
+// request as soon as the previous one returned. With a rate, requests are started on a
+// fixed schedule and their latency is measured from the time they were due, so a stalled
+// daemon shows up in the percentiles instead of slowing the generator down.
+//
+// Without -addr, loadgen starts a local daemon whose service connections take
+// -connect-delay to open: "warm" keeps -pool of them in a chapter3.ResourcePool, "cold"
+// opens one per request, and "both" measures one after the other. These three flags are
+// rejected together with -addr.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ndarayudha/concurrency-in-go/chapter3"
+)
+
+type config struct {
+	concurrency int
+	rate        float64
+	duration    time.Duration
+	timeout     time.Duration
+}
+
+func main() {
+	addr := flag.String("addr", "", "daemon to load, a local one is started when empty")
+	mode := flag.String("mode", "both", "local daemon: warm, cold or both, not with -addr")
+	pool := flag.Int("pool", 10, "local daemon: service connections kept warm, not with -addr")
+	connectDelay := flag.Duration("connect-delay", 10*time.Millisecond, "local daemon: time to open a service connection, not with -addr")
+	var cfg config
+	flag.IntVar(&cfg.concurrency, "c", 16, "concurrent requests")
+	flag.Float64Var(&cfg.rate, "rate", 0, "requests per second, 0 for closed-loop")
+	flag.DurationVar(&cfg.duration, "d", 10*time.Second, "test duration")
+	flag.DurationVar(&cfg.timeout, "timeout", 5*time.Second, "timeout of a single request")
+	flag.Parse()
+
+	if cfg.concurrency < 1 || cfg.duration <= 0 || cfg.rate < 0 || cfg.rate > 0 && cfg.interval() <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *addr != "" {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "mode", "pool", "connect-delay":
+				log.Fatalf("-%s only applies to the local daemon, not to -addr", f.Name)
+			}
+		})
+	}
+
+	var modes []string
+	switch *mode {
+	case "warm", "cold":
+		modes = []string{*mode}
+	case "both":
+		modes = []string{"warm", "cold"}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "target\trequests\terrors\treq/s\tp50\tp90\tp99\tp999\tmax\t")
+	defer w.Flush()
+
+	if *addr != "" {
+		printReport(w, *addr, run(*addr, cfg))
+		return
+	}
+
+	for _, m := range modes {
+		daemon, stop, err := startLocalDaemon(m == "warm", *pool, *connectDelay)
+		if err != nil {
+			// log.Fatalf skips the deferred Flush, keep the rows already measured
+			w.Flush()
+			log.Fatalf("cannot start %s daemon: %v", m, err)
+		}
+		r := run(daemon.Addr().String(), cfg)
+		stop()
+		printReport(w, m, r)
+	}
+}
+
+// startLocalDaemon starts the daemon of 5_pool_test.go: with warm it serves from a pool of
+// service connections, without it opens a service connection for every request.
+func startLocalDaemon(warm bool, poolSize int, connectDelay time.Duration) (*chapter3.Daemon, func(), error) {
+	connectToService := func(ctx context.Context) (interface{}, error) {
+		time.Sleep(connectDelay)
+		return struct{}{}, nil
+	}
+
+	daemon := &chapter3.Daemon{Address: "localhost:0"}
+	closePool := func() {}
+	if warm {
+		pool, err := chapter3.NewResourcePool(chapter3.PoolOptions[interface{}]{
+			New: connectToService,
+			Min: poolSize,
+			Max: poolSize,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		closePool = pool.Close
+		daemon.Handler = func(done <-chan struct{}, conn net.Conn) {
+			svcConn, err := pool.Get(context.Background())
+			if err != nil {
+				log.Printf("cannot get service connection: %v", err)
+				return
+			}
+			fmt.Fprintln(conn, "")
+			svcConn.Release()
+		}
+	} else {
+		daemon.Handler = func(done <-chan struct{}, conn net.Conn) {
+			connectToService(context.Background())
+			fmt.Fprintln(conn, "")
+		}
+	}
+
+	if err := daemon.Start(); err != nil {
+		closePool()
+		return nil, nil, err
+	}
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := daemon.Shutdown(ctx); err != nil {
+			log.Printf("cannot shut down daemon: %v", err)
+		}
+		closePool()
+	}
+	return daemon, stop, nil
+}
+
+// interval returns the time between two requests at cfg.rate. Rates above one request
+// per nanosecond give 0, which main rejects.
+func (cfg config) interval() time.Duration {
+	return time.Duration(float64(time.Second) / cfg.rate)
+}
+
+type report struct {
+	latencies []time.Duration
+	errors    int
+	elapsed   time.Duration
+}
+
+// run loads addr for cfg.duration and collects the latency of every request.
+func run(addr string, cfg config) report {
+	// due carries the time a request was due; closed-loop requests are due when sent
+	due := make(chan time.Time, cfg.concurrency)
+	start := time.Now()
+	end := start.Add(cfg.duration)
+
+	go func() {
+		defer close(due)
+		if cfg.rate == 0 {
+			for time.Now().Before(end) {
+				due <- time.Time{}
+			}
+			return
+		}
+
+		interval := cfg.interval()
+		for next := start; next.Before(end); next = next.Add(interval) {
+			time.Sleep(time.Until(next))
+			due <- next
+		}
+	}()
+
+	results := make(chan report, cfg.concurrency)
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			var r report
+			for at := range due {
+				if at.IsZero() {
+					at = time.Now()
+				}
+				if err := request(addr, cfg.timeout); err != nil {
+					r.errors++
+					continue
+				}
+				r.latencies = append(r.latencies, time.Since(at))
+			}
+			results <- r
+		}()
+	}
+	workers.Wait()
+	close(results)
+
+	total := report{elapsed: time.Since(start)}
+	for r := range results {
+		total.latencies = append(total.latencies, r.latencies...)
+		total.errors += r.errors
+	}
+	sort.Slice(total.latencies, func(i, j int) bool { return total.latencies[i] < total.latencies[j] })
+	return total
+}
+
+func request(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = io.ReadAll(conn)
+	return err
+}
+
+// quantile returns the q-quantile of sorted latencies, the latency of rank q*n counted
+// from 1 as chapter4's histograms do: q = 0 is the fastest request, q = 1 the slowest.
+func (r report) quantile(q float64) time.Duration {
+	n := len(r.latencies)
+	if n == 0 {
+		return 0
+	}
+	rank := min(max(int(q*float64(n)), 1), n)
+	return r.latencies[rank-1]
+}
+
+func printReport(w io.Writer, target string, r report) {
+	n := len(r.latencies) + r.errors
+	fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%v\t\n",
+		target, n, r.errors, float64(len(r.latencies))/r.elapsed.Seconds(),
+		r.quantile(0.5), r.quantile(0.9), r.quantile(0.99), r.quantile(0.999), r.quantile(1))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuantile(t *testing.T) {
+	r := report{}
+	if q := r.quantile(0.5); q != 0 {
+		t.Fatalf("quantile of no latencies = %v", q)
+	}
+
+	for i := 1; i <= 1000; i++ {
+		r.latencies = append(r.latencies, time.Duration(i))
+	}
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 1},
+		{0.5, 500},
+		{0.9, 900},
+		{0.999, 999},
+		{1, 1000},
+	} {
+		if got := r.quantile(tt.q); got != tt.want {
+			t.Errorf("quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func startTestDaemon(t *testing.T, warm bool, connectDelay time.Duration) string {
+	t.Helper()
+	daemon, stop, err := startLocalDaemon(warm, 2, connectDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return daemon.Addr().String()
+}
+
+func TestRunClosedLoop(t *testing.T) {
+	addr := startTestDaemon(t, true, time.Millisecond)
+	r := run(addr, config{concurrency: 2, duration: 50 * time.Millisecond, timeout: time.Second})
+
+	if r.errors != 0 || len(r.latencies) == 0 {
+		t.Fatalf("%d requests, %d errors", len(r.latencies), r.errors)
+	}
+	for i := 1; i < len(r.latencies); i++ {
+		if r.latencies[i] < r.latencies[i-1] {
+			t.Fatal("latencies are not sorted")
+		}
+	}
+
+	var out bytes.Buffer
+	printReport(&out, "warm", r)
+	if fields := strings.Split(out.String(), "\t"); len(fields) != 10 || fields[0] != "warm" {
+		t.Fatalf("report row %q", out.String())
+	}
+}
+
+func TestRunRate(t *testing.T) {
+	// one worker, requests due every 10ms, each one taking 30ms: the schedule falls
+	// behind, and the latency counted from the due time shows it
+	addr := startTestDaemon(t, false, 30*time.Millisecond)
+	r := run(addr, config{concurrency: 1, rate: 100, duration: 100 * time.Millisecond, timeout: time.Second})
+
+	if n := len(r.latencies) + r.errors; n != 10 || r.errors != 0 {
+		t.Fatalf("%d requests with %d errors, want 10 scheduled ones without errors", n, r.errors)
+	}
+	if r.quantile(0) < 30*time.Millisecond {
+		t.Errorf("fastest request took %v, less than the service time", r.quantile(0))
+	}
+	if r.quantile(1) < 150*time.Millisecond {
+		t.Errorf("slowest request took %v, the time spent waiting for its turn is missing", r.quantile(1))
+	}
+}
+
+func TestInterval(t *testing.T) {
+	if d := (config{rate: 100}).interval(); d != 10*time.Millisecond {
+		t.Errorf("interval at 100/s = %v", d)
+	}
+	// main rejects rates whose interval truncates to 0, the schedule would never advance
+	if d := (config{rate: 1e10}).interval(); d > 0 {
+		t.Errorf("interval at 1e10/s = %v, want 0", d)
+	}
+}
@@ -0,0 +1,102 @@
+// Command lockbench measures sync.Locker implementations under contention.
+//
+//	lockbench [-locks mutex,rwmutex] [-k 8] [-read-ratios 0,0.5,0.9] [-sections 0,100ns,1us] [-keys 1024] [-format csv|json] [-o file]
+//
+// Every lock runs every combination of read ratio, critical section length and goroutine
+// count 1, 2, 4, ... 2^k, as chapter3.LockBenchMatrix does, and the results are written as
+// CSV or JSON for plotting. The locks are those of chapter3.Locks: the sync package's
+// mutex and rwmutex, and chapter3's instrumented and striped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ndarayudha/concurrency-in-go/chapter3"
+)
+
+func main() {
+	lockNames := flag.String("locks", "mutex,rwmutex", "comma-separated locks to measure: "+strings.Join(names(chapter3.Locks()), ","))
+	maxLog2 := flag.Int("k", 8, "measure 1 to 2^k goroutines")
+	ratios := flag.String("read-ratios", "0,0.5,0.9,0.99", "comma-separated shares of read operations")
+	sections := flag.String("sections", "0,100ns,1us", "comma-separated critical section lengths")
+	keys := flag.Int("keys", 1024, "keys the operations are spread over")
+	ops := flag.Int("ops", 10000, "lock acquisitions per goroutine")
+	format := flag.String("format", "csv", "output format: csv or json")
+	output := flag.String("o", "", "output file, stdout when empty")
+	flag.Parse()
+
+	available := chapter3.Locks()
+	locks := make(map[string]chapter3.LockFactory)
+	for _, name := range strings.Split(*lockNames, ",") {
+		f, ok := available[name]
+		if !ok {
+			log.Fatalf("unknown lock %q", name)
+		}
+		locks[name] = f
+	}
+
+	readRatios, err := parseList(*ratios, func(s string) (float64, error) {
+		return strconv.ParseFloat(s, 64)
+	})
+	if err != nil {
+		log.Fatalf("invalid -read-ratios: %v", err)
+	}
+	lengths, err := parseList(*sections, time.ParseDuration)
+	if err != nil {
+		log.Fatalf("invalid -sections: %v", err)
+	}
+
+	var write func(io.Writer, []chapter3.LockBenchResult) error
+	switch *format {
+	case "csv":
+		write = chapter3.WriteLockBenchCSV
+	case "json":
+		write = chapter3.WriteLockBenchJSON
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("cannot create output: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	results := chapter3.LockBenchMatrix(locks, *maxLog2, readRatios, lengths, *keys, *ops)
+	if err := write(w, results); err != nil {
+		log.Fatalf("cannot write results: %v", err)
+	}
+}
+
+func names(locks map[string]chapter3.LockFactory) []string {
+	var names []string
+	for name := range locks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseList[T any](list string, parse func(string) (T, error)) ([]T, error) {
+	var values []T
+	for _, s := range strings.Split(list, ",") {
+		v, err := parse(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
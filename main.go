@@ -4,11 +4,16 @@ import (
 	"fmt"
 	"sync"
   "time"
+
+	"github.com/ndarayudha/concurrency-in-go/chapter3"
 )
 
 func main() {
 	var wg sync.WaitGroup
-	var sharedLock sync.Mutex
+	// sharedLock records how long the workers wait for it and hold it
+	var sharedLock chapter3.InstrumentedMutex
+	var lockStats chapter3.LockStats
+	sharedLock.Instrument(&lockStats)
 	const runtime = 1 * time.Second
 
 	greedyWorker := func() {
@@ -51,4 +56,10 @@ func main() {
   go greedyWorker()
   go politeWorker()
   wg.Wait()
+
+	wait, hold := lockStats.Wait.Snapshot(), lockStats.Hold.Snapshot()
+	fmt.Printf("sharedLock: %d acquisitions, %d contended\n",
+		lockStats.Acquisitions.Load(), lockStats.Contended.Load())
+	fmt.Printf("  wait: mean %v, p50 %v, p99 %v\n", wait.Mean(), wait.Quantile(0.5), wait.Quantile(0.99))
+	fmt.Printf("  hold: mean %v, p50 %v, p99 %v\n", hold.Mean(), hold.Quantile(0.5), hold.Quantile(0.99))
 }